@@ -0,0 +1,291 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shogo82148/androidbinary/apk"
+)
+
+type apkCertificate struct {
+	Subject  string    `json:"subject"`
+	Issuer   string    `json:"issuer"`
+	NotAfter time.Time `json:"notAfter"`
+	Sha256   string    `json:"sha256"`
+	Schemes  []string  `json:"schemes"` // signature schemes using this certificate, eg: v1, v2
+}
+
+type apkInspection struct {
+	PackageName  string           `json:"packageName"`
+	VersionCode  int              `json:"versionCode"`
+	VersionName  string           `json:"versionName"`
+	MinSdk       int              `json:"minSdk"`
+	TargetSdk    int              `json:"targetSdk"`
+	MainActivity string           `json:"mainActivity"`
+	Activities   []string         `json:"activities"`
+	Permissions  []string         `json:"permissions"`
+	ABIs         []string         `json:"abis"` // empty means no native libraries
+	Certificates []apkCertificate `json:"certificates"`
+	// v1, v2, v3, v3.1, empty means unsigned or signed with unsupported scheme
+	SignatureSchemes []string `json:"signatureSchemes"`
+	Size             int64    `json:"size"`
+
+	Compatible        bool     `json:"compatible"`
+	Incompatibilities []string `json:"incompatibilities,omitempty"`
+}
+
+func inspectAPK(filename string) (*apkInspection, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	pkg, err := apk.OpenFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer pkg.Close()
+	manifest := pkg.Manifest()
+	info := &apkInspection{
+		PackageName:  pkg.PackageName(),
+		VersionCode:  manifest.VersionCode,
+		VersionName:  manifest.VersionName,
+		MinSdk:       manifest.SDK.Min,
+		TargetSdk:    manifest.SDK.Target,
+		Activities:   []string{},
+		Permissions:  []string{},
+		Certificates: []apkCertificate{},
+		Size:         fi.Size(),
+	}
+	info.MainActivity, _ = pkg.MainAcitivty()
+	for _, activity := range manifest.App.Activities {
+		info.Activities = append(info.Activities, activity.Name)
+	}
+	for _, perm := range manifest.UsesPermissions {
+		info.Permissions = append(info.Permissions, perm.Name)
+	}
+	if info.ABIs, err = apkNativeABIs(filename); err != nil {
+		return nil, err
+	}
+	if info.Certificates, info.SignatureSchemes, err = apkCertificates(filename); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// apkNativeABIs return abis in lib/<abi>/*.so, eg: arm64-v8a
+func apkNativeABIs(filename string) ([]string, error) {
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	found := make(map[string]bool)
+	abis := []string{}
+	for _, f := range zr.File {
+		parts := strings.Split(f.Name, "/")
+		if len(parts) == 3 && parts[0] == "lib" && strings.HasSuffix(parts[2], ".so") && !found[parts[1]] {
+			found[parts[1]] = true
+			abis = append(abis, parts[1])
+		}
+	}
+	sort.Strings(abis)
+	return abis, nil
+}
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+// only certificates are needed, crls and signer infos are ignored
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// parsePKCS7Certificates return certificates in the PKCS#7 signature block
+func parsePKCS7Certificates(data []byte) ([]*x509.Certificate, error) {
+	var info pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	var signedData pkcs7SignedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &signedData); err != nil {
+		return nil, err
+	}
+	if len(signedData.Certificates.Bytes) == 0 {
+		return nil, errors.New("no certificate in pkcs7")
+	}
+	return x509.ParseCertificates(signedData.Certificates.Bytes)
+}
+
+// apkCertificates read v1 signature in META-INF and v2, v3 signature in the APK Signing Block
+func apkCertificates(filename string) (certs []apkCertificate, schemes []string, err error) {
+	certs, schemes = []apkCertificate{}, []string{}
+	addCerts := func(scheme string, x509Certs []*x509.Certificate) {
+		schemes = append(schemes, scheme)
+	NEXT:
+		for _, cert := range x509Certs {
+			sha256 := certFingerprint(cert.Raw)
+			for i := range certs {
+				if certs[i].Sha256 == sha256 {
+					certs[i].Schemes = append(certs[i].Schemes, scheme)
+					continue NEXT
+				}
+			}
+			certs = append(certs, apkCertificate{
+				Subject:  cert.Subject.String(),
+				Issuer:   cert.Issuer.String(),
+				NotAfter: cert.NotAfter,
+				Sha256:   sha256,
+				Schemes:  []string{scheme},
+			})
+		}
+	}
+
+	v1Certs, err := apkV1Certificates(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(v1Certs) > 0 {
+		addCerts("v1", v1Certs)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := readAPKSigningBlock(f, fi.Size())
+	if err == errNoAPKSigningBlock {
+		return certs, schemes, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, scheme := range apkSignatureSchemes {
+		value, ok := block[scheme.ID]
+		if !ok {
+			continue
+		}
+		x509Certs, err := parseAPKSignerCertificates(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse %s signature: %v", scheme.Name, err)
+		}
+		addCerts(scheme.Name, x509Certs)
+	}
+	return certs, schemes, nil
+}
+
+// apkV1Certificates read certificates of the PKCS#7 signature files in META-INF
+func apkV1Certificates(filename string) ([]*x509.Certificate, error) {
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	var certs []*x509.Certificate
+	for _, f := range zr.File {
+		if !strings.HasPrefix(f.Name, "META-INF/") {
+			continue
+		}
+		switch strings.ToUpper(filepath.Ext(f.Name)) {
+		case ".RSA", ".DSA", ".EC":
+		default:
+			continue
+		}
+		rd, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(rd)
+		rd.Close()
+		if err != nil {
+			return nil, err
+		}
+		x509Certs, err := parsePKCS7Certificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %v", f.Name, err)
+		}
+		certs = append(certs, x509Certs...)
+	}
+	return certs, nil
+}
+
+// checkAPKCompatible compare with device sdk and abis(format like arm64-v8a)
+func checkAPKCompatible(info *apkInspection, sdk int, abis []string) {
+	info.Incompatibilities = nil
+	if sdk > 0 && info.MinSdk > sdk {
+		info.Incompatibilities = append(info.Incompatibilities, fmt.Sprintf("minSdk %d is higher than device sdk %d", info.MinSdk, sdk))
+	}
+	if len(info.ABIs) > 0 && len(abis) > 0 {
+		supported := false
+		for _, abi := range abis {
+			for _, apkABI := range info.ABIs {
+				if abi == apkABI {
+					supported = true
+				}
+			}
+		}
+		if !supported {
+			info.Incompatibilities = append(info.Incompatibilities, fmt.Sprintf("abis %v are not supported by device %v", info.ABIs, abis))
+		}
+	}
+	info.Compatible = len(info.Incompatibilities) == 0
+}
+
+// handleAPKInspect inspect apk uploaded with multipart field "file" or downloaded from url
+func handleAPKInspect(w http.ResponseWriter, r *http.Request) {
+	var filename string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		files, err := saveMultipartFiles(r, "/sdcard/tmp", 0644, nil)
+		defer removeFiles(files)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filename = files[0]
+	} else {
+		url := r.FormValue("url")
+		if url == "" {
+			http.Error(w, "file or url is required", http.StatusBadRequest)
+			return
+		}
+		filename = TempFileName("/sdcard/tmp", ".apk")
+		defer os.Remove(filename)
+		os.MkdirAll(filepath.Dir(filename), 0755)
+		if _, err := httpDownload(filename, url, 0644); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	info, err := inspectAPK(filename)
+	if err != nil {
+		http.Error(w, "inspect apk: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	abis := deviceABIs()
+	for i, abi := range abis {
+		abis[i] = strings.Replace(abi, "_", "-", -1)
+	}
+	checkAPKCompatible(info, getDeviceInfo().Sdk, abis)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
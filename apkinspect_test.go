@@ -0,0 +1,204 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// makePKCS7 build a degenerate signed data which only contains the certificate
+func makePKCS7(t *testing.T, certDer []byte) []byte {
+	signedData, err := asn1.Marshal(struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      struct{ ContentType asn1.ObjectIdentifier }
+		Certificates     asn1.RawValue `asn1:"tag:0"`
+		SignerInfos      asn1.RawValue
+	}{
+		Version:          1,
+		DigestAlgorithms: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true},
+		ContentInfo:      struct{ ContentType asn1.ObjectIdentifier }{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certDer},
+		SignerInfos:      asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true},
+	})
+	assert.NoError(t, err)
+	data, err := asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}{
+		ContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2},
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData},
+	})
+	assert.NoError(t, err)
+	return data
+}
+
+func TestAPKNativeABIsAndCertificates(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Android Debug"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(30, 0, 0),
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "atx-apk")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "app.apk")
+	f, _ := os.Create(filename)
+	zw := zip.NewWriter(f)
+	for _, name := range []string{"AndroidManifest.xml", "lib/arm64-v8a/libfoo.so", "lib/armeabi-v7a/libfoo.so", "lib/arm64-v8a/libbar.so", "assets/lib/x86/a.so"} {
+		zw.Create(name)
+	}
+	wr, _ := zw.Create("META-INF/CERT.RSA")
+	wr.Write(makePKCS7(t, certDer))
+	zw.Close()
+	f.Close()
+
+	abis, err := apkNativeABIs(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"arm64-v8a", "armeabi-v7a"}, abis)
+
+	certs, schemes, err := apkCertificates(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"v1"}, schemes)
+	assert.Len(t, certs, 1)
+	assert.Equal(t, "CN=Android Debug", certs[0].Subject)
+	assert.Equal(t, certFingerprint(certDer), certs[0].Sha256)
+
+	// signed with v1 and v2, the certificate is the same
+	insertAPKSigningBlock(t, filename, map[uint32][]byte{0x7109871a: makeSignerBlock(certDer)})
+	abis, err = apkNativeABIs(filename)
+	assert.NoError(t, err)
+	assert.Len(t, abis, 2)
+	certs, schemes, err = apkCertificates(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"v1", "v2"}, schemes)
+	assert.Len(t, certs, 1)
+	assert.Equal(t, []string{"v1", "v2"}, certs[0].Schemes)
+}
+
+func TestAPKCertificatesV3Only(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Release"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(30, 0, 0),
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "atx-apk")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "app.apk")
+	f, _ := os.Create(filename)
+	zw := zip.NewWriter(f)
+	zw.Create("AndroidManifest.xml")
+	zw.Close()
+	f.Close()
+
+	certs, schemes, err := apkCertificates(filename)
+	assert.NoError(t, err)
+	assert.Len(t, schemes, 0, "unsigned")
+	assert.Len(t, certs, 0)
+
+	insertAPKSigningBlock(t, filename, map[uint32][]byte{
+		0x42726577: make([]byte, 100), // padding
+		0xf05368c0: makeSignerBlock(certDer),
+	})
+	certs, schemes, err = apkCertificates(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"v3"}, schemes)
+	if assert.Len(t, certs, 1) {
+		assert.Equal(t, "CN=Release", certs[0].Subject)
+	}
+
+	insertAPKSigningBlock(t, filename, map[uint32][]byte{0x7109871a: {1, 2, 3}})
+	_, _, err = apkCertificates(filename)
+	assert.Error(t, err)
+}
+
+func appendLengthPrefixed(buf *bytes.Buffer, values ...[]byte) {
+	for _, value := range values {
+		binary.Write(buf, binary.LittleEndian, uint32(len(value)))
+		buf.Write(value)
+	}
+}
+
+// makeSignerBlock build v2/v3 signature block value with one signer, digests and signatures are empty
+func makeSignerBlock(certDer []byte) []byte {
+	certs := bytes.NewBuffer(nil)
+	appendLengthPrefixed(certs, certDer)
+	signedData := bytes.NewBuffer(nil)
+	appendLengthPrefixed(signedData, nil, certs.Bytes(), nil)
+	signer := bytes.NewBuffer(nil)
+	appendLengthPrefixed(signer, signedData.Bytes(), nil, nil)
+	signers := bytes.NewBuffer(nil)
+	appendLengthPrefixed(signers, signer.Bytes())
+	value := bytes.NewBuffer(nil)
+	appendLengthPrefixed(value, signers.Bytes())
+	return value.Bytes()
+}
+
+// insertAPKSigningBlock insert the block before central directory, like apksigner does
+func insertAPKSigningBlock(t *testing.T, filename string, values map[uint32][]byte) {
+	data, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err)
+	eocd := bytes.LastIndex(data, []byte("PK\x05\x06"))
+	cdOffset := binary.LittleEndian.Uint32(data[eocd+16:])
+
+	pairs := bytes.NewBuffer(nil)
+	for id, value := range values {
+		binary.Write(pairs, binary.LittleEndian, uint64(len(value)+4))
+		binary.Write(pairs, binary.LittleEndian, id)
+		pairs.Write(value)
+	}
+	blockSize := uint64(pairs.Len() + 24)
+	block := bytes.NewBuffer(nil)
+	binary.Write(block, binary.LittleEndian, blockSize)
+	block.Write(pairs.Bytes())
+	binary.Write(block, binary.LittleEndian, blockSize)
+	block.WriteString("APK Sig Block 42")
+
+	out := bytes.NewBuffer(nil)
+	out.Write(data[:cdOffset])
+	out.Write(block.Bytes())
+	out.Write(data[cdOffset:])
+	result := out.Bytes()
+	binary.LittleEndian.PutUint32(result[eocd+block.Len()+16:], cdOffset+uint32(block.Len()))
+	assert.NoError(t, ioutil.WriteFile(filename, result, 0644))
+}
+
+func TestCheckAPKCompatible(t *testing.T) {
+	info := &apkInspection{MinSdk: 21, ABIs: []string{"x86"}}
+	checkAPKCompatible(info, 19, []string{"arm64-v8a", "armeabi-v7a"})
+	assert.False(t, info.Compatible)
+	assert.Len(t, info.Incompatibilities, 2)
+
+	info = &apkInspection{MinSdk: 21, ABIs: []string{"armeabi-v7a"}}
+	checkAPKCompatible(info, 23, []string{"arm64-v8a", "armeabi-v7a"})
+	assert.True(t, info.Compatible)
+
+	info = &apkInspection{MinSdk: 15}
+	checkAPKCompatible(info, 23, []string{"x86"})
+	assert.True(t, info.Compatible)
+}
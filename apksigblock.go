@@ -0,0 +1,150 @@
+/*
+APK Signing Block, used by signature scheme v2 and v3
+https://source.android.com/security/apksigning/v2
+*/
+package main
+
+import (
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	apkSigBlockMagic  = "APK Sig Block 42"
+	zipEOCDSignature  = "PK\x05\x06"
+	zipEOCDMinSize    = 22
+	zipMaxCommentSize = 65535
+)
+
+// in the order of preference
+var apkSignatureSchemes = []struct {
+	ID   uint32
+	Name string
+}{
+	{0x7109871a, "v2"},
+	{0xf05368c0, "v3"},
+	{0x1b93ad61, "v3.1"},
+}
+
+var errNoAPKSigningBlock = errors.New("apk signing block not found")
+
+// zipCentralDirectoryOffset read offset of the central directory from the end of central directory record
+func zipCentralDirectoryOffset(r io.ReaderAt, size int64) (int64, error) {
+	n := int64(zipEOCDMinSize + zipMaxCommentSize)
+	if n > size {
+		n = size
+	}
+	buf := make([]byte, n)
+	if _, err := r.ReadAt(buf, size-n); err != nil && err != io.EOF {
+		return 0, err
+	}
+	for i := len(buf) - zipEOCDMinSize; i >= 0; i-- {
+		if string(buf[i:i+4]) == zipEOCDSignature {
+			return int64(binary.LittleEndian.Uint32(buf[i+16:])), nil
+		}
+	}
+	return 0, errors.New("zip end of central directory not found")
+}
+
+// readAPKSigningBlock return values of the APK Signing Block by id, the block is placed just before the central directory
+func readAPKSigningBlock(r io.ReaderAt, size int64) (map[uint32][]byte, error) {
+	cdOffset, err := zipCentralDirectoryOffset(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if cdOffset < 32 || cdOffset > size {
+		return nil, errNoAPKSigningBlock
+	}
+	// footer: uint64 size of block, magic
+	footer := make([]byte, 24)
+	if _, err := r.ReadAt(footer, cdOffset-24); err != nil {
+		return nil, err
+	}
+	if string(footer[8:]) != apkSigBlockMagic {
+		return nil, errNoAPKSigningBlock
+	}
+	blockSize := binary.LittleEndian.Uint64(footer)
+	if blockSize < 24 || blockSize > uint64(cdOffset-8) {
+		return nil, errors.New("invalid apk signing block size")
+	}
+	block := make([]byte, blockSize+8)
+	if _, err := r.ReadAt(block, cdOffset-int64(len(block))); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint64(block) != blockSize {
+		return nil, errors.New("apk signing block size mismatch")
+	}
+	// pairs of uint64 length, uint32 id, value
+	values := make(map[uint32][]byte)
+	pairs := block[8 : len(block)-24]
+	for len(pairs) > 0 {
+		if len(pairs) < 8 {
+			return nil, errors.New("invalid apk signing block pair")
+		}
+		pairLen := binary.LittleEndian.Uint64(pairs)
+		pairs = pairs[8:]
+		if pairLen < 4 || pairLen > uint64(len(pairs)) {
+			return nil, errors.New("invalid apk signing block pair length")
+		}
+		values[binary.LittleEndian.Uint32(pairs)] = pairs[4:pairLen]
+		pairs = pairs[pairLen:]
+	}
+	return values, nil
+}
+
+// readLengthPrefixed split data into the uint32 length-prefixed value and the rest
+func readLengthPrefixed(data []byte) (value, rest []byte, err error) {
+	if len(data) < 4 {
+		return nil, nil, errors.New("length prefix out of range")
+	}
+	n := binary.LittleEndian.Uint32(data)
+	if uint64(n) > uint64(len(data)-4) {
+		return nil, nil, errors.New("length prefixed value out of range")
+	}
+	return data[4 : 4+n], data[4+n:], nil
+}
+
+// parseAPKSignerCertificates return certificates of all signers in v2 or v3 signature block
+// signer: signed data(digests, certificates, ...), ...
+func parseAPKSignerCertificates(value []byte) ([]*x509.Certificate, error) {
+	signers, _, err := readLengthPrefixed(value)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for len(signers) > 0 {
+		var signer []byte
+		if signer, signers, err = readLengthPrefixed(signers); err != nil {
+			return nil, err
+		}
+		signedData, _, err := readLengthPrefixed(signer)
+		if err != nil {
+			return nil, err
+		}
+		_, rest, err := readLengthPrefixed(signedData) // digests
+		if err != nil {
+			return nil, err
+		}
+		certsData, _, err := readLengthPrefixed(rest)
+		if err != nil {
+			return nil, err
+		}
+		for len(certsData) > 0 {
+			var der []byte
+			if der, certsData, err = readLengthPrefixed(certsData); err != nil {
+				return nil, err
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		}
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate in signature block")
+	}
+	return certs, nil
+}
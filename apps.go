@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/codeskyblue/procfs"
+)
+
+const userHZ = 100 // clock ticks per second, always 100 on android
+
+// android 5-9: mResumedActivity: ActivityRecord{c1d2e3 u0 com.example/.MainActivity t12}
+// android 10+: ResumedActivity: ActivityRecord{...}, topResumedActivity=ActivityRecord{...}
+var resumedActivityRe = regexp.MustCompile(`(?:mResumedActivity|ResumedActivity|mFocusedActivity)[:=]\s*ActivityRecord\{\w+ (?:u\d+ )?([\w.]+)/([\w.$]+)`)
+
+type foregroundApp struct {
+	PackageName string `json:"packageName"`
+	Activity    string `json:"activity"`
+	Pid         int    `json:"pid"`
+}
+
+// parseForegroundActivity parse output of "dumpsys activity activities"
+func parseForegroundActivity(output string) (packageName, activity string) {
+	matches := resumedActivityRe.FindStringSubmatch(output)
+	if matches == nil {
+		return "", ""
+	}
+	packageName, activity = matches[1], matches[2]
+	if strings.HasPrefix(activity, ".") {
+		activity = packageName + activity
+	}
+	return
+}
+
+func currentForegroundApp() (*foregroundApp, error) {
+	output, err := runShellOutput("dumpsys", "activity", "activities")
+	if err != nil {
+		return nil, err
+	}
+	packageName, activity := parseForegroundActivity(string(output))
+	if packageName == "" {
+		return nil, errors.New("no resumed activity found")
+	}
+	app := &foregroundApp{PackageName: packageName, Activity: activity}
+	app.Pid, _ = pidOf(packageName)
+	return app, nil
+}
+
+type runningApp struct {
+	PackageName string   `json:"packageName"`
+	Pids        []int    `json:"pids"`
+	Processes   []string `json:"processes"`
+	Foreground  bool     `json:"foreground"`
+	Uptime      float64  `json:"uptime"` // seconds since the earliest process started
+}
+
+type appProcess struct {
+	pid       int
+	name      string // com.example or com.example:remote
+	startTime uint64 // clock ticks after boot
+}
+
+// groupAppProcesses group processes by package, processes not belongs to packages are ignored
+func groupAppProcesses(procs []appProcess, packages map[string]bool, foreground string, systemUptime float64) []*runningApp {
+	apps := make(map[string]*runningApp)
+	for _, proc := range procs {
+		packageName := strings.SplitN(proc.name, ":", 2)[0]
+		if !packages[packageName] {
+			continue
+		}
+		app, ok := apps[packageName]
+		if !ok {
+			app = &runningApp{PackageName: packageName, Foreground: packageName == foreground}
+			apps[packageName] = app
+		}
+		app.Pids = append(app.Pids, proc.pid)
+		app.Processes = append(app.Processes, proc.name)
+		if uptime := systemUptime - float64(proc.startTime)/userHZ; uptime > app.Uptime {
+			app.Uptime = uptime
+		}
+	}
+	result := make([]*runningApp, 0, len(apps))
+	for _, app := range apps {
+		result = append(result, app)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].PackageName < result[j].PackageName
+	})
+	return result
+}
+
+func readSystemUptime() (float64, error) {
+	data, err := ioutil.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+	var uptime float64
+	_, err = fmt.Sscanf(string(data), "%f", &uptime)
+	return uptime, err
+}
+
+func listRunningApps() ([]*runningApp, error) {
+	output, err := runShellOutput("pm", "list", "packages")
+	if err != nil {
+		return nil, err
+	}
+	packages := make(map[string]bool)
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "package:") {
+			packages[strings.TrimSpace(strings.TrimPrefix(line, "package:"))] = true
+		}
+	}
+	uptime, err := readSystemUptime()
+	if err != nil {
+		return nil, err
+	}
+	fs, err := procfs.NewFS(procfs.DefaultMountPoint)
+	if err != nil {
+		return nil, err
+	}
+	allProcs, err := fs.AllProcs()
+	if err != nil {
+		return nil, err
+	}
+	procs := make([]appProcess, 0, len(allProcs))
+	for _, proc := range allProcs {
+		cmdline, _ := proc.CmdLine()
+		if len(cmdline) != 1 {
+			continue
+		}
+		stat, err := proc.NewStat()
+		if err != nil {
+			continue // process exited
+		}
+		procs = append(procs, appProcess{pid: proc.PID, name: cmdline[0], startTime: stat.Starttime})
+	}
+	var foreground string
+	if app, err := currentForegroundApp(); err == nil {
+		foreground = app.PackageName
+	}
+	return groupAppProcesses(procs, packages, foreground, uptime), nil
+}
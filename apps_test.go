@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseForegroundActivity(t *testing.T) {
+	pkg, activity := parseForegroundActivity(`
+  Stack #1:
+    mResumedActivity: ActivityRecord{c1d2e3 u0 com.example/.MainActivity t12}
+  mFocusedActivity: ActivityRecord{c1d2e3 u0 com.example/.MainActivity t12}`)
+	assert.Equal(t, "com.example", pkg)
+	assert.Equal(t, "com.example.MainActivity", activity)
+
+	pkg, activity = parseForegroundActivity(`    topResumedActivity=ActivityRecord{5f6a7b u0 com.android.settings/com.android.settings.Settings$WifiSettingsActivity t34}`)
+	assert.Equal(t, "com.android.settings", pkg)
+	assert.Equal(t, "com.android.settings.Settings$WifiSettingsActivity", activity)
+
+	pkg, _ = parseForegroundActivity("")
+	assert.Equal(t, "", pkg)
+}
+
+func TestGroupAppProcesses(t *testing.T) {
+	packages := map[string]bool{"com.example": true, "com.github.uiautomator": true}
+	apps := groupAppProcesses([]appProcess{
+		{pid: 1, name: "init", startTime: 0},
+		{pid: 1200, name: "com.example", startTime: 5000},
+		{pid: 1300, name: "com.example:push", startTime: 3000},
+		{pid: 1400, name: "com.github.uiautomator", startTime: 9000},
+	}, packages, "com.example", 100)
+	assert.Len(t, apps, 2)
+	assert.Equal(t, "com.example", apps[0].PackageName)
+	assert.Equal(t, []int{1200, 1300}, apps[0].Pids)
+	assert.True(t, apps[0].Foreground)
+	assert.Equal(t, 70.0, apps[0].Uptime)
+	assert.False(t, apps[1].Foreground)
+	assert.Equal(t, 10.0, apps[1].Uptime)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mholt/archiver"
+)
+
+var archiveFormats = map[string]archiver.Archiver{
+	"tar.gz": archiver.TarGz,
+	"zip":    archiver.Zip,
+}
+
+func archiverOf(format string) (archiver.Archiver, error) {
+	if format == "" {
+		format = "tar.gz"
+	}
+	ar, ok := archiveFormats[format]
+	if !ok {
+		return nil, errors.New("unsupported archive format: " + format)
+	}
+	return ar, nil
+}
+
+// writeArchive write the contents of dir (without dir itself) into wr
+func writeArchive(wr io.Writer, ar archiver.Archiver, dir string) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	sources := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		sources = append(sources, filepath.Join(dir, fi.Name()))
+	}
+	return ar.Write(wr, sources)
+}
+
+// archiveFile is read twice, entries are checked before extracted
+type archiveFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
+type archiveEntryError struct {
+	name   string
+	reason string
+}
+
+func (e *archiveEntryError) Error() string {
+	return "unsafe archive entry " + e.name + ": " + e.reason
+}
+
+// checkArchiveEntry reject entries may be extracted outside of the directory
+// Link target with .. is rejected even if it's inside after clean, eg: a -> . and b -> a/../../x
+func checkArchiveEntry(name, linkname string) error {
+	for _, path := range []string{name, linkname} {
+		if strings.HasPrefix(filepath.ToSlash(path), "/") {
+			return &archiveEntryError{name, "absolute path " + path}
+		}
+		if checkDotDot(path) != nil {
+			return &archiveEntryError{name, path + " contains .."}
+		}
+	}
+	return nil
+}
+
+func checkTarGzEntries(rd io.Reader) error {
+	gzr, err := gzip.NewReader(rd)
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		linkname := ""
+		if header.Typeflag == tar.TypeSymlink || header.Typeflag == tar.TypeLink {
+			linkname = header.Linkname
+		}
+		if err := checkArchiveEntry(header.Name, linkname); err != nil {
+			return err
+		}
+	}
+}
+
+func checkZipEntries(ra io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		linkname := ""
+		if zf.Mode()&os.ModeSymlink != 0 {
+			// content of symlink entry is the target
+			rc, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			data, err := ioutil.ReadAll(io.LimitReader(rc, 4096))
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			linkname = string(data)
+		}
+		if err := checkArchiveEntry(zf.Name, linkname); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkArchive(f archiveFile, format string) error {
+	if format == "zip" {
+		size, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		return checkZipEntries(f, size)
+	}
+	return checkTarGzEntries(f)
+}
+
+// extractArchive extract into a temp directory first, then replace target with it
+// target will not be touched if anything goes wrong
+func extractArchive(f archiveFile, format string, target string, overwrite bool) error {
+	ar, err := archiverOf(format)
+	if err != nil {
+		return err
+	}
+	if err := checkArchive(f, format); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	target = filepath.Clean(target)
+	if _, err := os.Lstat(target); err == nil && !overwrite {
+		return &os.PathError{Op: "extract", Path: target, Err: os.ErrExist}
+	}
+	parent := filepath.Dir(target)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir(parent, "."+filepath.Base(target)+".extract-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := ar.Read(f, tmpDir); err != nil {
+		return err
+	}
+	os.Chmod(tmpDir, 0755)
+
+	if _, err := os.Lstat(target); os.IsNotExist(err) {
+		return os.Rename(tmpDir, target)
+	}
+	backup := tmpDir + ".old"
+	if err := os.Rename(target, backup); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpDir, target); err != nil {
+		os.Rename(backup, target) // restore
+		return err
+	}
+	return os.RemoveAll(backup)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckArchiveEntry(t *testing.T) {
+	assert.NoError(t, checkArchiveEntry("a/b.txt", ""))
+	assert.NoError(t, checkArchiveEntry("lib/libfoo.so", "libfoo.so.1"))
+	assert.Error(t, checkArchiveEntry("/etc/passwd", ""))
+	assert.Error(t, checkArchiveEntry("a/../../b.txt", ""))
+	assert.Error(t, checkArchiveEntry("link", "/sdcard"))
+	assert.Error(t, checkArchiveEntry("link", "a/../../.."))
+}
+
+func TestCheckArchive(t *testing.T) {
+	tarGz := func(headers ...*tar.Header) *bytes.Reader {
+		buf := bytes.NewBuffer(nil)
+		gzw := gzip.NewWriter(buf)
+		tw := tar.NewWriter(gzw)
+		for _, h := range headers {
+			tw.WriteHeader(h)
+		}
+		tw.Close()
+		gzw.Close()
+		return bytes.NewReader(buf.Bytes())
+	}
+	assert.NoError(t, checkArchive(tarGz(
+		&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "target"},
+	), "tar.gz"))
+	// the second entry is written through the symlink
+	err := checkArchive(tarGz(
+		&tar.Header{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: "/data/local/tmp"},
+		&tar.Header{Name: "escape/atx-agent", Typeflag: tar.TypeReg, Mode: 0755},
+	), "tar.gz")
+	assert.Error(t, err)
+	assert.Equal(t, 400, fileErrorStatus(err))
+
+	buf := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buf)
+	fh := &zip.FileHeader{Name: "link"}
+	fh.SetMode(os.ModeSymlink | 0777)
+	w, _ := zw.CreateHeader(fh)
+	w.Write([]byte("../outside"))
+	zw.Close()
+	assert.Error(t, checkArchive(bytes.NewReader(buf.Bytes()), "zip"))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+var termRecordFolder = "/sdcard/termrecords/"
+
+// asciicastRecorder write terminal output and resize events as asciicast v2
+// Ref: https://github.com/asciinema/asciinema/blob/develop/doc/asciicast-v2.md
+type asciicastRecorder struct {
+	Name string
+
+	mu        sync.Mutex
+	file      *os.File
+	startedAt time.Time
+	partial   []byte // incomplete utf-8 bytes left by last output
+}
+
+func newAsciicastRecorder(sessionId string, width, height int) (*asciicastRecorder, error) {
+	os.MkdirAll(termRecordFolder, 0755)
+	startedAt := time.Now()
+	safeId := regexp.MustCompile(`[^\w.-]`).ReplaceAllString(sessionId, "_")
+	name := fmt.Sprintf("%s-%s.cast", safeId, startedAt.Format("20060102-150405"))
+	file, err := os.Create(filepath.Join(termRecordFolder, name))
+	if err != nil {
+		return nil, err
+	}
+	header, _ := json.Marshal(map[string]interface{}{
+		"version":   2,
+		"width":     width,
+		"height":    height,
+		"timestamp": startedAt.Unix(),
+		"env": map[string]string{
+			"TERM": "xterm",
+		},
+	})
+	if _, err := file.Write(append(header, '\n')); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &asciicastRecorder{
+		Name:      name,
+		file:      file,
+		startedAt: startedAt,
+	}, nil
+}
+
+func (r *asciicastRecorder) writeEvent(code string, data string) error {
+	line, err := json.Marshal([]interface{}{time.Since(r.startedAt).Seconds(), code, data})
+	if err != nil {
+		return err
+	}
+	_, err = r.file.Write(append(line, '\n'))
+	return err
+}
+
+// Output record data written by the terminal, rune split by read buffer is joined with the next output
+func (r *asciicastRecorder) Output(data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data = append(r.partial, data...)
+	r.partial = nil
+	for i := 1; i <= utf8.UTFMax-1 && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				r.partial = append([]byte(nil), data[len(data)-i:]...)
+				data = data[:len(data)-i]
+			}
+			break
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return r.writeEvent("o", string(data))
+}
+
+func (r *asciicastRecorder) Resize(cols, rows int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writeEvent("r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+func (r *asciicastRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.partial) > 0 {
+		r.writeEvent("o", string(r.partial))
+		r.partial = nil
+	}
+	return r.file.Close()
+}
+
+type termRecordInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+func handleTermRecords(w http.ResponseWriter, r *http.Request) {
+	files, _ := ioutil.ReadDir(termRecordFolder)
+	records := []termRecordInfo{}
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".cast" {
+			continue
+		}
+		records = append(records, termRecordInfo{
+			Name:    f.Name(),
+			Size:    f.Size(),
+			ModTime: f.ModTime(),
+		})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ModTime.Before(records[j].ModTime)
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
+
+func handleTermRecordDownload(w http.ResponseWriter, r *http.Request) {
+	name := filepath.Base(mux.Vars(r)["name"])
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	http.ServeFile(w, r, filepath.Join(termRecordFolder, name))
+}
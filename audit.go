@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultAuditLogFile = "/data/local/tmp/atx-agent-audit.log" // not in /sdcard, which is readable by every app
+	auditMaxSize        = 5 * 1024 * 1024
+	auditMaxBackups     = 3
+	auditMaxValue       = 256       // params longer than this are truncated
+	auditMaxFormSize    = 64 * 1024 // larger urlencoded body is not logged
+)
+
+const (
+	auditPhaseStart  = "start"  // logged before handled, in case the request never returns, eg: reboot
+	auditPhaseFinish = "finish" // logged after handled with response status
+)
+
+// GET requests under these prefixes also change the device
+var auditRoutePrefixes = []string{"/shell", "/exec", "/jobs", "/term", "/upgrade", "/stop", "/install", "/uiautomator"}
+
+type auditEntry struct {
+	ID         uint64            `json:"id"` // same for the start and finish entry of a request
+	Phase      string            `json:"phase"`
+	Time       time.Time         `json:"time"`
+	RemoteAddr string            `json:"remoteAddr"`
+	Identity   string            `json:"identity,omitempty"`
+	Method     string            `json:"method"`
+	Route      string            `json:"route"`
+	Params     map[string]string `json:"params,omitempty"`
+	Status     int               `json:"status,omitempty"`   // finish only
+	Duration   float64           `json:"duration,omitempty"` // seconds, finish only
+}
+
+// AuditLog append json lines into filename, rotated as filename.1, filename.2 ...
+type AuditLog struct {
+	filename   string
+	maxSize    int64
+	maxBackups int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	lastID uint64
+}
+
+var auditLog = newAuditLog(defaultAuditLogFile)
+
+func newAuditLog(filename string) *AuditLog {
+	a := &AuditLog{
+		filename:   filename,
+		maxSize:    auditMaxSize,
+		maxBackups: auditMaxBackups,
+	}
+	if a.Enabled() {
+		a.lastID = a.lastEntryID()
+	}
+	return a
+}
+
+// lastEntryID return the max id of the newest log file, so ids keep increasing after restart
+func (a *AuditLog) lastEntryID() uint64 {
+	for n := 0; n <= a.maxBackups; n++ {
+		filename := a.filename
+		if n > 0 {
+			filename = a.backupName(n)
+		}
+		f, err := os.Open(filename)
+		if err != nil {
+			continue
+		}
+		var lastID uint64
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var entry auditEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) == nil && entry.ID > lastID {
+				lastID = entry.ID
+			}
+		}
+		f.Close()
+		if lastID > 0 {
+			return lastID
+		}
+	}
+	return 0
+}
+
+func (a *AuditLog) Enabled() bool {
+	return a.filename != ""
+}
+
+func (a *AuditLog) Write(entry auditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil && a.size+int64(len(line)) > a.maxSize {
+		a.file.Close()
+		a.file = nil
+		a.rotate()
+	}
+	if a.file == nil {
+		f, err := os.OpenFile(a.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		a.file, a.size = f, fi.Size()
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+func (a *AuditLog) backupName(n int) string {
+	return a.filename + "." + strconv.Itoa(n)
+}
+
+// Files return the log file and all backups
+func (a *AuditLog) Files() []string {
+	if !a.Enabled() {
+		return nil
+	}
+	files := []string{a.filename}
+	for n := 1; n <= a.maxBackups; n++ {
+		files = append(files, a.backupName(n))
+	}
+	return files
+}
+
+func (a *AuditLog) rotate() {
+	os.Remove(a.backupName(a.maxBackups))
+	for n := a.maxBackups - 1; n >= 1; n-- {
+		os.Rename(a.backupName(n), a.backupName(n+1))
+	}
+	os.Rename(a.filename, a.backupName(1))
+}
+
+// Query return entries logged after since, oldest first
+func (a *AuditLog) Query(since time.Time) ([]auditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	entries := make([]auditEntry, 0)
+	for n := a.maxBackups; n >= 0; n-- {
+		filename := a.filename
+		if n > 0 {
+			filename = a.backupName(n)
+		}
+		f, err := os.Open(filename)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var entry auditEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+				continue // broken line
+			}
+			if entry.Time.After(since) {
+				entries = append(entries, entry)
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func shouldAudit(r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return true
+	}
+	return routeMatch(r.URL.Path, auditRoutePrefixes)
+}
+
+// readAuditForm parse urlencoded body no larger than auditMaxFormSize
+// r.Body is restored, so the handler can still read the whole body
+func readAuditForm(r *http.Request) url.Values {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") || r.Body == nil {
+		return nil
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, auditMaxFormSize+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+	if err != nil || len(data) > auditMaxFormSize {
+		return nil
+	}
+	values, err := url.ParseQuery(string(data))
+	if err != nil {
+		return nil // not a form, eg: curl --data-binary
+	}
+	return values
+}
+
+// auditParams collect query and urlencoded form values, multipart body is not parsed
+func auditParams(r *http.Request) map[string]string {
+	values := r.URL.Query()
+	for key, vs := range readAuditForm(r) {
+		values[key] = append(values[key], vs...)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	params := make(map[string]string, len(values))
+	for key, vs := range values {
+		if key == "token" {
+			continue
+		}
+		value := strings.Join(vs, ",")
+		if len(value) > auditMaxValue {
+			value = value[:auditMaxValue] + "..."
+		}
+		params[key] = value
+	}
+	return params
+}
+
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *auditResponseWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *auditResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack is required by websocket
+func (w *auditResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (a *AuditLog) writeEntry(entry auditEntry) {
+	if err := a.Write(entry); err != nil {
+		log.Println("audit log error:", err)
+	}
+}
+
+// Middleware log mutating requests before and after they are handled
+// It should wrap auth.Middleware, so requests rejected with 401 or 403 are also logged
+func (a *AuditLog) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.Enabled() || !shouldAudit(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		entry := auditEntry{
+			ID:         atomic.AddUint64(&a.lastID, 1),
+			Phase:      auditPhaseStart,
+			Time:       time.Now(),
+			RemoteAddr: r.RemoteAddr,
+			Identity:   auth.Identify(r),
+			Method:     r.Method,
+			Route:      r.URL.Path,
+			Params:     auditParams(r),
+		}
+		a.writeEntry(entry)
+
+		aw := &auditResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r)
+		entry.Phase = auditPhaseFinish
+		entry.Status = aw.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		entry.Duration = time.Since(entry.Time).Seconds()
+		entry.Time = time.Now()
+		a.writeEntry(entry)
+	})
+}
+
+// parseSince accept RFC3339 time or unix timestamp, empty means all
+func parseSince(since string) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+	if sec, err := strconv.ParseInt(since, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return t, fmt.Errorf("invalid since: %s, should be RFC3339 or unix timestamp", since)
+	}
+	return t, nil
+}
+
+func handleAuditQuery(w http.ResponseWriter, r *http.Request) {
+	since, err := parseSince(r.FormValue("since"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := auditLog.Query(since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
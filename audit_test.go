@@ -0,0 +1,190 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atx-audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	a := newAuditLog(filepath.Join(dir, "audit.log"))
+	a.maxSize = 200
+	a.maxBackups = 2
+	start := time.Now().Add(-time.Minute)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, a.Write(auditEntry{
+			Time:   start.Add(time.Duration(i) * time.Second),
+			Method: "POST",
+			Route:  "/shell",
+			Status: 200,
+		}))
+	}
+	assert.Equal(t, []string{a.filename, a.backupName(1), a.backupName(2)}, a.Files())
+	_, err = os.Stat(a.backupName(2))
+	assert.NoError(t, err)
+	_, err = os.Stat(a.backupName(3))
+	assert.True(t, os.IsNotExist(err))
+
+	entries, err := a.Query(time.Time{})
+	assert.NoError(t, err)
+	assert.True(t, len(entries) < 10) // oldest are rotated out
+	assert.Equal(t, start.Add(9*time.Second).Unix(), entries[len(entries)-1].Time.Unix())
+
+	entries, err = a.Query(start.Add(7 * time.Second))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atx-audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	a := newAuditLog(filepath.Join(dir, "audit.log"))
+	handler := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("command") == "" {
+			http.Error(w, "command required", http.StatusBadRequest)
+		}
+	}))
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/info", nil),
+		httptest.NewRequest("GET", "/shell?command=ls&token=secret", nil),
+		httptest.NewRequest("POST", "/shell", strings.NewReader(url.Values{"command": {"reboot"}}.Encode())),
+		httptest.NewRequest("DELETE", "/files/sdcard/a.txt", nil),
+	} {
+		if req.Method == "POST" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	entries, err := a.Query(time.Time{})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 6)
+	assert.Equal(t, map[string]string{"command": "ls"}, entries[0].Params)
+	assert.Equal(t, auditPhaseStart, entries[0].Phase)
+	assert.Equal(t, 0, entries[0].Status)
+	assert.Equal(t, auditPhaseFinish, entries[1].Phase)
+	assert.Equal(t, entries[0].ID, entries[1].ID)
+	assert.Equal(t, "reboot", entries[2].Params["command"])
+	assert.Equal(t, 200, entries[3].Status)
+	assert.Equal(t, "/files/sdcard/a.txt", entries[5].Route)
+	assert.Equal(t, 400, entries[5].Status)
+}
+
+func TestAuditLogIDAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atx-audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "audit.log")
+	handler := newAuditLog(filename).Middleware(http.NotFoundHandler())
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/shell", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/shell", nil))
+
+	a := newAuditLog(filename)
+	a.Middleware(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/shell", nil))
+	entries, err := a.Query(time.Time{})
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 6) {
+		assert.Equal(t, uint64(2), entries[3].ID)
+		assert.Equal(t, uint64(3), entries[5].ID)
+	}
+}
+
+func TestAuditMiddlewareRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atx-audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	origAuth := auth
+	defer func() { auth = origAuth }()
+	auth, err = newAuth([]authToken{{Token: "v", Name: "dashboard", Role: "viewer"}}, nil)
+	assert.NoError(t, err)
+
+	a := newAuditLog(filepath.Join(dir, "audit.log"))
+	handler := a.Middleware(auth.Middleware(http.NotFoundHandler()))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/shell", nil))
+	req := httptest.NewRequest("POST", "/shell", nil)
+	req.Header.Set("Authorization", "Bearer v")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	entries, err := a.Query(time.Time{})
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 4) {
+		assert.Equal(t, "", entries[1].Identity)
+		assert.Equal(t, http.StatusUnauthorized, entries[1].Status)
+		assert.Equal(t, "dashboard", entries[3].Identity)
+		assert.Equal(t, http.StatusForbidden, entries[3].Status)
+	}
+}
+
+func TestAuditMiddlewareStartEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atx-audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	a := newAuditLog(filepath.Join(dir, "audit.log"))
+	handler := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the request is logged before handled, eg: reboot never returns
+		entries, err := a.Query(time.Time{})
+		assert.NoError(t, err)
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, auditPhaseStart, entries[0].Phase)
+			assert.Equal(t, "reboot", entries[0].Params["command"])
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/shell?command=reboot", nil))
+}
+
+func TestAuditMiddlewareKeepBody(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atx-audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	a := newAuditLog(filepath.Join(dir, "audit.log"))
+	var body []byte
+	handler := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+
+	// curl --data-binary sends application/x-www-form-urlencoded
+	chunk := strings.Repeat("\x00binary chunk", 10000)
+	req := httptest.NewRequest("PUT", "/uploads/1?offset=0", strings.NewReader(chunk))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, chunk, string(body))
+
+	req = httptest.NewRequest("POST", "/shell", strings.NewReader("command=ls"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "command=ls", string(body))
+
+	entries, err := a.Query(time.Time{})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 4)
+	assert.Equal(t, map[string]string{"offset": "0"}, entries[0].Params)
+	assert.Equal(t, map[string]string{"command": "ls"}, entries[2].Params)
+}
+
+func TestParseSince(t *testing.T) {
+	ts, err := parseSince("1500000000")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1500000000), ts.Unix())
+	ts, err = parseSince("2018-03-01T10:00:00+08:00")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, ts.UTC().Hour())
+	_, err = parseSince("yesterday")
+	assert.Error(t, err)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+type authRole int
+
+const (
+	roleNone authRole = iota
+	roleViewer
+	roleOperator
+	roleAdmin
+)
+
+var authRoleNames = map[string]authRole{
+	"viewer":   roleViewer,
+	"operator": roleOperator,
+	"admin":    roleAdmin,
+}
+
+func (r authRole) String() string {
+	for name, role := range authRoleNames {
+		if role == r {
+			return name
+		}
+	}
+	return "none"
+}
+
+type authToken struct {
+	Token string `json:"token"`
+	Name  string `json:"name"`
+	Role  string `json:"role"` // viewer, operator, admin
+	role  authRole
+}
+
+// Auth check bearer tokens and websocket origins
+// No tokens means authentication is disabled, no origins means any origin is allowed
+type Auth struct {
+	tokens  map[string]authToken
+	origins []string
+}
+
+var auth = &Auth{}
+
+// loadAuthTokens read tokens from json file, eg: [{"token": "xxx", "name": "ci", "role": "operator"}]
+func loadAuthTokens(filename string) ([]authToken, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var tokens []authToken
+	if err := json.NewDecoder(f).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func newAuth(tokens []authToken, origins []string) (*Auth, error) {
+	a := &Auth{
+		tokens:  make(map[string]authToken, len(tokens)),
+		origins: origins,
+	}
+	for _, t := range tokens {
+		if t.Token == "" {
+			return nil, errors.New("empty token for " + t.Name)
+		}
+		role, ok := authRoleNames[t.Role]
+		if !ok {
+			return nil, errors.New("unknown role: " + t.Role)
+		}
+		t.role = role
+		a.tokens[t.Token] = t
+	}
+	return a, nil
+}
+
+func (a *Auth) Enabled() bool {
+	return len(a.tokens) > 0
+}
+
+// AdminToken is used by the agent itself, eg: stop the previous server
+func (a *Auth) AdminToken() string {
+	for _, t := range a.tokens {
+		if t.role == roleAdmin {
+			return t.Token
+		}
+	}
+	return ""
+}
+
+// routes need admin role, which can run any command on device
+var adminRoutePrefixes = []string{"/shell", "/exec", "/jobs", "/term", "/upgrade", "/stop", "/audit"}
+
+// routes need operator role even with GET, because they can control the device
+var operatorRoutePrefixes = []string{"/minitouch", "/jsonrpc/", "/session/", "/uiautomator", "/install", "/upload"}
+
+func routeMatch(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredRole return the minimal role for the request
+func requiredRole(r *http.Request) authRole {
+	path := r.URL.Path
+	switch {
+	case routeMatch(path, adminRoutePrefixes):
+		return roleAdmin
+	case routeMatch(path, operatorRoutePrefixes):
+		return roleOperator
+	case r.Method != "GET" && r.Method != "HEAD":
+		return roleOperator
+	case path == "/" || path == "/version" || strings.HasPrefix(path, "/assets/"): // static pages
+		return roleNone
+	default:
+		return roleViewer
+	}
+}
+
+// requestToken from header "Authorization: Bearer <token>", or ?token=<token> for websocket
+// Browser can not set header for websocket, query token of other requests is ignored to keep it out of urls and logs
+func requestToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return r.URL.Query().Get("token")
+	}
+	return ""
+}
+
+type authContextKey struct{}
+
+// authIdentity return the token name of the request, empty if auth disabled
+func authIdentity(r *http.Request) string {
+	if t, ok := r.Context().Value(authContextKey{}).(authToken); ok {
+		return t.Name
+	}
+	return ""
+}
+
+// Identify return the token name of the request without checking the role, empty if the token is unknown
+// It's used by the audit log, which also logs requests rejected by Middleware
+func (a *Auth) Identify(r *http.Request) string {
+	if t, ok := a.tokens[requestToken(r)]; ok {
+		return t.Name
+	}
+	return ""
+}
+
+func (a *Auth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		need := requiredRole(r)
+		t, ok := a.tokens[requestToken(r)]
+		if !ok {
+			if need == roleNone {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="atx-agent"`)
+			http.Error(w, "token required", http.StatusUnauthorized)
+			return
+		}
+		if t.role < need {
+			http.Error(w, "role "+t.role.String()+" is not allowed, need "+need.String(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authContextKey{}, t)))
+	})
+}
+
+// CheckOrigin for websocket upgrade, requests without Origin header are not from browser
+func (a *Auth) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(a.origins) == 0 || origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return true
+	}
+	for _, allowed := range a.origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	a, err := newAuth([]authToken{
+		{Token: "v", Name: "viewer", Role: "viewer"},
+		{Token: "o", Name: "ci", Role: "operator"},
+		{Token: "a", Name: "root", Role: "admin"},
+	}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", a.AdminToken())
+
+	handler := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, authIdentity(r))
+	}))
+	for _, tc := range []struct {
+		method, url, token string
+		websocket          bool
+		code               int
+	}{
+		{"GET", "/", "", false, 200},
+		{"GET", "/info", "", false, 401},
+		{"GET", "/info", "bad", false, 401},
+		{"GET", "/info", "v", false, 200},
+		{"GET", "/info?token=v", "", false, 401}, // query token is only for websocket
+		{"POST", "/upload/sdcard/", "v", false, 403},
+		{"POST", "/upload/sdcard/", "o", false, 200},
+		{"GET", "/minitouch?token=v", "", true, 403},
+		{"GET", "/minitouch?token=o", "", true, 200},
+		{"GET", "/shell?command=ls", "o", false, 403},
+		{"GET", "/shell/stream?command=ls", "a", false, 200},
+		{"GET", "/term/sessions", "o", false, 403},
+	} {
+		req := httptest.NewRequest(tc.method, tc.url, nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		if tc.websocket {
+			req.Header.Set("Upgrade", "websocket")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, tc.code, rec.Code, tc.method+" "+tc.url)
+	}
+
+	_, err = newAuth([]authToken{{Token: "x", Role: "root"}}, nil)
+	assert.Error(t, err)
+
+	// auth disabled by default
+	rec := httptest.NewRecorder()
+	(&Auth{}).Middleware(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest("GET", "/shell", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestAuthCheckOrigin(t *testing.T) {
+	a, _ := newAuth(nil, []string{"http://lab.example.com"})
+	req := httptest.NewRequest("GET", "http://10.0.0.1:7912/minicap", nil)
+	assert.True(t, a.CheckOrigin(req))
+	req.Header.Set("Origin", "http://lab.example.com")
+	assert.True(t, a.CheckOrigin(req))
+	req.Header.Set("Origin", "http://10.0.0.1:7912")
+	assert.True(t, a.CheckOrigin(req))
+	req.Header.Set("Origin", "http://evil.example.com")
+	assert.False(t, a.CheckOrigin(req))
+	assert.True(t, (&Auth{}).CheckOrigin(req))
+}
@@ -8,91 +8,278 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/DeanThompson/syncmap"
 	"github.com/franela/goreq"
 )
 
-const defaultDownloadTimeout = 30 * time.Minute
+const (
+	defaultDownloadTimeout  = 30 * time.Minute
+	defaultBackgroundExpire = 5 * time.Minute // finished tasks are deleted after expired
+)
 
 var background = &Background{
-	sm: syncmap.New(),
+	sm:     syncmap.New(),
+	expire: defaultBackgroundExpire,
 }
 
 type BackgroundState struct {
+	Key         string      `json:"key"`
+	Type        string      `json:"type,omitempty"` // download, upload or install
+	CreatedAt   time.Time   `json:"createdAt"`
 	Message     string      `json:"message"`
 	Error       string      `json:"error"`
 	Progress    interface{} `json:"progress"`
 	PackageName string      `json:"packageName,omitempty"`
+	State       string      `json:"state,omitempty"` // install state: queued, downloading, verifying, installing, done, failed
+	Code        string      `json:"code,omitempty"`  // install failure code, eg: INSTALL_FAILED_VERSION_DOWNGRADE
+	Retries     int         `json:"retries,omitempty"`
+
+	err   error
+	wg    sync.WaitGroup
+	timer *time.Timer // delete timer, nil before finished
+	mu    sync.Mutex  // guard State and Progress, which are read by Cancel
+}
+
+func (s *BackgroundState) setState(state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.State = state
+}
+
+func (s *BackgroundState) setProgress(progress interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Progress = progress
+}
 
-	err error
-	wg  sync.WaitGroup
+// downloadProxy return nil if the task is not downloading
+func (s *BackgroundState) downloadProxy() *downloadProxy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dproxy, ok := s.Progress.(*downloadProxy)
+	if !ok || s.State != installStateDownloading {
+		return nil
+	}
+	return dproxy
 }
 
 type Background struct {
-	sm    *syncmap.SyncMap
-	n     int
-	mu    sync.Mutex
-	timer *time.Timer
+	sm     *syncmap.SyncMap
+	n      int
+	mu     sync.Mutex
+	expire time.Duration
 }
 
-// Get return nil if not found
+// Get return nil if not found, the expiration of finished task is extended
 func (b *Background) Get(key string) (status *BackgroundState) {
 	value, ok := b.sm.Get(key)
 	if !ok {
 		return nil
 	}
-	if b.timer != nil {
-		b.delayDelete(key)
+	state := value.(*BackgroundState)
+	b.mu.Lock()
+	if state.timer != nil {
+		state.timer.Reset(b.expire)
+	}
+	b.mu.Unlock()
+	return state
+}
+
+// List return all tasks sorted by created time
+func (b *Background) List() []*BackgroundState {
+	states := make([]*BackgroundState, 0, b.sm.Size())
+	for item := range b.sm.IterItems() {
+		states = append(states, item.Value.(*BackgroundState))
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].CreatedAt.Before(states[j].CreatedAt)
+	})
+	return states
+}
+
+var (
+	errBackgroundNotFound      = errors.New("background task not found")
+	errBackgroundNotCancelable = errors.New("background task is finished or not cancelable")
+)
+
+// Cancel the running download
+func (b *Background) Cancel(key string) error {
+	state := b.Get(key)
+	if state == nil {
+		return errBackgroundNotFound
+	}
+	dproxy := state.downloadProxy()
+	if dproxy == nil {
+		return errBackgroundNotCancelable
 	}
-	return value.(*BackgroundState)
+	dproxy.Cancel()
+	return nil
 }
 
 // func (b *Background) InstallApk(filepath string) (key string) {
 // 	return
 // }
 
+func writeCancelResult(w http.ResponseWriter, err error) {
+	switch err {
+	case nil:
+		io.WriteString(w, "Cancelled")
+	case errBackgroundNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
+
 func (b *Background) genKey() (key string, state *BackgroundState) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	b.n++
 	key = fmt.Sprintf("%d", b.n)
-	state = &BackgroundState{}
+	state = &BackgroundState{Key: key, CreatedAt: time.Now()}
 	b.sm.Set(key, state)
 	return
 }
 
+// delayDelete should be called when the task finished, every key has its own timer
 func (b *Background) delayDelete(key string) {
-	delay := 5 * time.Minute
-	if b.timer == nil {
-		b.timer = time.AfterFunc(delay, func() {
+	value, ok := b.sm.Get(key)
+	if !ok {
+		return
+	}
+	state := value.(*BackgroundState)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if state.timer == nil {
+		state.timer = time.AfterFunc(b.expire, func() {
 			b.sm.Delete(key)
 		})
 	} else {
-		b.timer.Reset(delay)
+		state.timer.Reset(b.expire)
 	}
 }
 
 func (b *Background) HTTPDownload(urlStr string, dst string, mode os.FileMode) (key string) {
 	key, state := b.genKey()
+	state.Type = "download"
 	state.wg.Add(1)
 	go func() {
 		defer b.delayDelete(key)
-		b.Get(key).Message = "downloading"
-		if err := b.doHTTPDownload(key, urlStr, dst, mode); err != nil {
-			b.Get(key).Message = "http download: " + err.Error()
-		} else {
-			b.Get(key).Message = "downloaded"
+		state.setState(installStateDownloading)
+		state.Message = "downloading"
+		err := b.doHTTPDownload(key, urlStr, dst, mode)
+		switch {
+		case err == nil:
+			state.setState(installStateDone)
+			state.Message = "downloaded"
+		case isCanceled(state):
+			os.Remove(dst)
+			installFailed(state, installCodeCanceled, "canceled", err)
+		default:
+			installFailed(state, installCodeDownloadFailed, "http download: "+err.Error(), err)
 		}
 	}()
 	return
 }
 
+func isCanceled(state *BackgroundState) bool {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	dproxy, ok := state.Progress.(*downloadProxy)
+	return ok && dproxy.Canceled()
+}
+
+// HTTPUpload save all multipart fields named "file" of the request into dir
+// Different from HTTPDownload, it returns after the upload finished
+func (b *Background) HTTPUpload(r *http.Request, dir string, mode os.FileMode) (key string, files []string, err error) {
+	key, state := b.genKey()
+	state.Type = "upload"
+	state.Message = "uploading"
+	// content length is a little bigger than the files size
+	wrproxy := newDownloadProxy(nil, int(r.ContentLength))
+	defer wrproxy.Done()
+	state.setProgress(wrproxy)
+	if files, err = saveMultipartFiles(r, dir, mode, wrproxy); err != nil {
+		b.sm.Delete(key)
+		return "", nil, err
+	}
+	wrproxy.TotalSize = wrproxy.CopiedSize
+	state.Message = "uploaded"
+	return key, files, nil // the caller should delayDelete after the files are handled
+}
+
+// saveMultipartFiles save all multipart fields named "file" into dir, saved files are removed if error returned
+// The progress is reported into wrproxy if not nil
+func saveMultipartFiles(r *http.Request, dir string, mode os.FileMode, wrproxy *downloadProxy) (files []string, err error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	os.MkdirAll(dir, 0755)
+	defer func() {
+		if err != nil {
+			removeFiles(files)
+			files = nil
+		}
+	}()
+	for {
+		part, er := mr.NextPart()
+		if er == io.EOF {
+			break
+		}
+		if er != nil {
+			return files, er
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+		ext := filepath.Ext(part.FileName())
+		if ext == "" {
+			ext = ".apk"
+		}
+		dst := TempFileName(dir, ext)
+		files = append(files, dst)
+		if err = saveUploadPart(part, dst, mode, wrproxy); err != nil {
+			return
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("multipart field file is required")
+	}
+	return files, nil
+}
+
+func saveUploadPart(part *multipart.Part, dst string, mode os.FileMode, wrproxy *downloadProxy) error {
+	defer part.Close()
+	file, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var wr io.Writer = file
+	if wrproxy != nil {
+		wrproxy.writer = file // files are written one by one
+		wr = wrproxy
+	}
+	if _, err := io.Copy(wr, part); err != nil {
+		return err
+	}
+	if mode != 0 {
+		os.Chmod(dst, mode)
+	}
+	return nil
+}
+
 func (b *Background) Wait(key string) error {
 	state := b.Get(key)
 	if state == nil {
@@ -143,7 +330,7 @@ func (b *Background) doHTTPDownload(key, urlStr, dst string, fileMode os.FileMod
 	fmt.Sscanf(res.Header.Get("Content-Length"), "%d", &totalSize)
 	wrproxy := newDownloadProxy(file, totalSize)
 	defer wrproxy.Done()
-	b.Get(key).Progress = wrproxy
+	state.setProgress(wrproxy)
 
 	// timeout here
 	timer := time.AfterFunc(defaultDownloadTimeout, func() {
@@ -165,7 +352,7 @@ type downloadProxy struct {
 	// Id         string      `json:"id"`
 	// Message    string      `json:"message"`
 	// ExtraData  interface{} `json:"extraData,omitempty"`
-	canceled   bool
+	canceled   int32 // set by other goroutine, use atomic
 	writer     io.Writer
 	TotalSize  int    `json:"totalSize"`
 	CopiedSize int    `json:"copiedSize"`
@@ -183,11 +370,15 @@ func newDownloadProxy(wr io.Writer, totalSize int) *downloadProxy {
 }
 
 func (d *downloadProxy) Cancel() {
-	d.canceled = true
+	atomic.StoreInt32(&d.canceled, 1)
+}
+
+func (d *downloadProxy) Canceled() bool {
+	return atomic.LoadInt32(&d.canceled) == 1
 }
 
 func (d *downloadProxy) Write(data []byte) (int, error) {
-	if d.canceled {
+	if d.Canceled() {
 		return 0, errors.New("download proxy was canceled")
 	}
 	n, err := d.writer.Write(data)
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DeanThompson/syncmap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackgroundDelayDelete(t *testing.T) {
+	b := &Background{sm: syncmap.New(), expire: 50 * time.Millisecond}
+	key1, _ := b.genKey()
+	key2, _ := b.genKey()
+	key3, _ := b.genKey()
+	b.delayDelete(key1)
+	b.delayDelete(key2)
+	assert.Len(t, b.List(), 3)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, b.Get(key1))
+	assert.Nil(t, b.Get(key2))
+	assert.NotNil(t, b.Get(key3), "unfinished task should not expire")
+	assert.Equal(t, key3, b.List()[0].Key)
+}
+
+func TestBackgroundCancel(t *testing.T) {
+	b := &Background{sm: syncmap.New(), expire: time.Minute}
+	assert.Equal(t, errBackgroundNotFound, b.Cancel("100"))
+
+	key, state := b.genKey()
+	assert.Equal(t, errBackgroundNotCancelable, b.Cancel(key))
+
+	dproxy := newDownloadProxy(nil, 100)
+	state.setProgress(dproxy)
+	state.setState(installStateDownloading)
+	assert.NoError(t, b.Cancel(key))
+	assert.True(t, isCanceled(state))
+	_, err := dproxy.Write([]byte("data"))
+	assert.Error(t, err)
+
+	state.setState(installStateFailed)
+	assert.Equal(t, errBackgroundNotCancelable, b.Cancel(key))
+
+	// cancel while the download goroutine updates state, run with -race
+	key, state = b.genKey()
+	done := make(chan bool)
+	go func() {
+		state.setProgress(newDownloadProxy(nil, 100))
+		state.setState(installStateDownloading)
+		state.setState(installStateDone)
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		b.Cancel(key)
+	}
+	<-done
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type fileInfo struct {
+	Name       string    `json:"name"`
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	Mode       string    `json:"mode"` // eg: 0644
+	ModeString string    `json:"modeString"`
+	IsDir      bool      `json:"isDir"`
+	ModTime    time.Time `json:"modTime"`
+	Symlink    string    `json:"symlink,omitempty"` // symlink target
+}
+
+func newFileInfo(path string, fi os.FileInfo) fileInfo {
+	info := fileInfo{
+		Name:       fi.Name(),
+		Path:       path,
+		Size:       fi.Size(),
+		Mode:       fmt.Sprintf("0%o", fi.Mode().Perm()),
+		ModeString: fi.Mode().String(),
+		IsDir:      fi.IsDir(),
+		ModTime:    fi.ModTime(),
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		info.Symlink, _ = os.Readlink(path)
+		if st, err := os.Stat(path); err == nil {
+			info.IsDir = st.IsDir()
+		}
+	}
+	return info
+}
+
+// statFile do not follow symlink
+func statFile(path string) (info fileInfo, err error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return
+	}
+	return newFileInfo(path, fi), nil
+}
+
+func listDir(dir string) (infos []fileInfo, err error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	infos = make([]fileInfo, 0, len(fis))
+	for _, fi := range fis {
+		infos = append(infos, newFileInfo(filepath.Join(dir, fi.Name()), fi))
+	}
+	return
+}
+
+var errIntoItself = errors.New("destination is inside the source directory")
+
+// realPath resolve symlinks of path, which may not exist yet
+func realPath(path string) string {
+	path = filepath.Clean(path)
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		return real
+	}
+	if dir := filepath.Dir(path); dir != path {
+		return filepath.Join(realPath(dir), filepath.Base(path))
+	}
+	return path
+}
+
+// isInside return true if path is dir or under dir
+func isInside(dir, path string) bool {
+	rel, err := filepath.Rel(realPath(dir), realPath(path))
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// copyPath copy file or directory recursively, symlinks are copied as symlink
+func copyPath(src, dst string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() && isInside(src, dst) {
+		return errIntoItself // copy forever
+	}
+	return copyTree(src, dst)
+}
+
+func copyTree(src, dst string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return &os.PathError{Op: "copy", Path: dst, Err: os.ErrExist}
+	}
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	case fi.IsDir():
+		if err := os.MkdirAll(dst, fi.Mode().Perm()); err != nil {
+			return err
+		}
+		fis, err := ioutil.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, child := range fis {
+			if err := copyTree(filepath.Join(src, child.Name()), filepath.Join(dst, child.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	case fi.Mode().IsRegular():
+		return copyFile(src, dst, fi.Mode().Perm())
+	default:
+		return errors.New("unsupported file type: " + src)
+	}
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// movePath rename first, fallback to copy and remove when crossing filesystems, eg: /data to /sdcard
+func movePath(src, dst string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return &os.PathError{Op: "move", Path: dst, Err: os.ErrExist}
+	}
+	if fi.IsDir() && isInside(src, dst) {
+		return errIntoItself
+	}
+	err = os.Rename(src, dst)
+	if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+		return err // nil, or errors not fixed by copy, eg: EACCES
+	}
+	if err := copyPath(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// requestPath return the absolute path from url vars
+func requestPath(r *http.Request, name string) string {
+	path := mux.Vars(r)[name]
+	if runtime.GOOS != "windows" {
+		path = "/" + path
+	}
+	return path
+}
+
+func fileErrorStatus(err error) int {
+	switch {
+	case os.IsNotExist(err):
+		return http.StatusNotFound
+	case os.IsPermission(err):
+		return http.StatusForbidden
+	case os.IsExist(err):
+		return http.StatusConflict
+	case err == errIntoItself:
+		return http.StatusBadRequest
+	}
+	if _, ok := err.(*archiveEntryError); ok {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTestTree(t *testing.T, root string) {
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "a/b"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "a/1.txt"), []byte("one"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "a/b/2.txt"), []byte("two"), 0600))
+	assert.NoError(t, os.Symlink("1.txt", filepath.Join(root, "a/link")))
+}
+
+func TestCopyPath(t *testing.T) {
+	root, err := ioutil.TempDir("", "atx-files")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+	makeTestTree(t, root)
+
+	assert.NoError(t, copyPath(filepath.Join(root, "a"), filepath.Join(root, "c")))
+	data, err := ioutil.ReadFile(filepath.Join(root, "c/b/2.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "two", string(data))
+	fi, err := os.Stat(filepath.Join(root, "c/b/2.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	target, err := os.Readlink(filepath.Join(root, "c/link"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1.txt", target)
+
+	err = copyPath(filepath.Join(root, "a/1.txt"), filepath.Join(root, "c/1.txt"))
+	assert.True(t, os.IsExist(err))
+
+	// destination inside the source
+	assert.Equal(t, errIntoItself, copyPath(filepath.Join(root, "a"), filepath.Join(root, "a/b/a")))
+	assert.Equal(t, errIntoItself, copyPath(filepath.Join(root, "a"), filepath.Join(root, "a", "..", "a", "x")))
+	_, err = os.Stat(filepath.Join(root, "a/b/a"))
+	assert.True(t, os.IsNotExist(err))
+	// similar prefix is not inside
+	assert.NoError(t, copyPath(filepath.Join(root, "a"), filepath.Join(root, "ab")))
+	// file can be copied into the same directory
+	assert.NoError(t, copyPath(filepath.Join(root, "a/1.txt"), filepath.Join(root, "a/3.txt")))
+}
+
+func TestMovePath(t *testing.T) {
+	root, err := ioutil.TempDir("", "atx-files")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+	makeTestTree(t, root)
+
+	assert.NoError(t, movePath(filepath.Join(root, "a"), filepath.Join(root, "c")))
+	_, err = os.Stat(filepath.Join(root, "a"))
+	assert.True(t, os.IsNotExist(err))
+	data, err := ioutil.ReadFile(filepath.Join(root, "c/1.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "one", string(data))
+
+	assert.True(t, os.IsNotExist(movePath(filepath.Join(root, "a"), filepath.Join(root, "d"))))
+	assert.NoError(t, os.Mkdir(filepath.Join(root, "d"), 0755))
+	assert.True(t, os.IsExist(movePath(filepath.Join(root, "c"), filepath.Join(root, "d"))))
+	assert.Equal(t, errIntoItself, movePath(filepath.Join(root, "c"), filepath.Join(root, "c/b/c")))
+
+	// rename errors other than EXDEV are returned without copying
+	err = movePath(filepath.Join(root, "c"), filepath.Join(root, "missing/c"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(root, "missing"))
+	assert.True(t, os.IsNotExist(err))
+	if os.Getuid() != 0 {
+		assert.NoError(t, os.Chmod(filepath.Join(root, "d"), 0555))
+		defer os.Chmod(filepath.Join(root, "d"), 0755)
+		err = movePath(filepath.Join(root, "c"), filepath.Join(root, "d/c"))
+		assert.True(t, os.IsPermission(err))
+		_, err = os.Stat(filepath.Join(root, "d/c"))
+		assert.True(t, os.IsNotExist(err))
+		_, err = os.Stat(filepath.Join(root, "c/1.txt"))
+		assert.NoError(t, err)
+	}
+}
@@ -0,0 +1,193 @@
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/gorilla/websocket"
+)
+
+const inotifyWatchMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_DELETE | syscall.IN_DELETE_SELF | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+type fileEvent struct {
+	Type  string    `json:"type"` // create, modify, close_write, delete, move_from, move_to
+	Path  string    `json:"path"`
+	IsDir bool      `json:"isDir"`
+	Time  time.Time `json:"time"`
+}
+
+var inotifyEventTypes = []struct {
+	mask uint32
+	name string
+}{
+	{syscall.IN_CREATE, "create"},
+	{syscall.IN_MODIFY, "modify"},
+	{syscall.IN_CLOSE_WRITE, "close_write"},
+	{syscall.IN_DELETE, "delete"},
+	{syscall.IN_DELETE_SELF, "delete"},
+	{syscall.IN_MOVED_FROM, "move_from"},
+	{syscall.IN_MOVED_TO, "move_to"},
+}
+
+type fileWatcher struct {
+	file      *os.File
+	fd        int
+	recursive bool
+	paths     map[int]string // watch descriptor -> path
+}
+
+func newFileWatcher(recursive bool) (*fileWatcher, error) {
+	// nonblock so that Close will interrupt the pending Read
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	return &fileWatcher{
+		file:      os.NewFile(uintptr(fd), "inotify"),
+		fd:        fd,
+		recursive: recursive,
+		paths:     make(map[int]string),
+	}, nil
+}
+
+// Add watch path, sub directories are also watched when recursive
+func (fw *fileWatcher) Add(path string) error {
+	wd, err := syscall.InotifyAddWatch(fw.fd, path, inotifyWatchMask)
+	if err != nil {
+		return err
+	}
+	fw.paths[wd] = path
+	if !fw.recursive {
+		return nil
+	}
+	return filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() || p == path {
+			return nil
+		}
+		if wd, err := syscall.InotifyAddWatch(fw.fd, p, inotifyWatchMask); err == nil {
+			fw.paths[wd] = p
+		}
+		return nil
+	})
+}
+
+var errWatchRemoved = errors.New("watched path removed")
+
+// ReadEvents block until events come
+// errWatchRemoved is returned along with the last events when no path is watched, eg: the path deleted
+func (fw *fileWatcher) ReadEvents() ([]fileEvent, error) {
+	var buf [syscall.SizeofInotifyEvent * 256]byte
+	n, err := fw.file.Read(buf[:])
+	if err != nil {
+		return nil, err
+	}
+	events := make([]fileEvent, 0, 4)
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+		raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(raw.Len)]
+		offset += syscall.SizeofInotifyEvent + int(raw.Len)
+
+		dir, ok := fw.paths[int(raw.Wd)]
+		if !ok {
+			continue
+		}
+		if raw.Mask&syscall.IN_IGNORED != 0 {
+			delete(fw.paths, int(raw.Wd))
+			continue
+		}
+		path := dir
+		if name := string(trimNull(nameBytes)); name != "" {
+			path = filepath.Join(dir, name)
+		}
+		isDir := raw.Mask&syscall.IN_ISDIR != 0
+		if isDir && fw.recursive && raw.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+			fw.Add(path)
+		}
+		for _, et := range inotifyEventTypes {
+			if raw.Mask&et.mask != 0 {
+				events = append(events, fileEvent{
+					Type:  et.name,
+					Path:  path,
+					IsDir: isDir,
+					Time:  time.Now(),
+				})
+			}
+		}
+	}
+	if len(fw.paths) == 0 {
+		return events, errWatchRemoved
+	}
+	return events, nil
+}
+
+func (fw *fileWatcher) Close() error {
+	return fw.file.Close()
+}
+
+func trimNull(data []byte) []byte {
+	for i, b := range data {
+		if b == 0 {
+			return data[:i]
+		}
+	}
+	return data
+}
+
+// handleFileWatch stream file events of ?path=<path>&recursive=true as json over websocket
+func handleFileWatch(w http.ResponseWriter, r *http.Request, path string) {
+	fw, err := newFileWatcher(r.FormValue("recursive") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := fw.Add(path); err != nil {
+		fw.Close()
+		http.Error(w, err.Error(), fileErrorStatus(err))
+		return
+	}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fw.Close()
+		return
+	}
+	defer ws.Close()
+	log.Printf("file watch %s from %v", path, r.RemoteAddr)
+
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				fw.Close() // stop ReadEvents
+				return
+			}
+		}
+	}()
+	const wsWriteWait = 10 * time.Second
+	for {
+		events, err := fw.ReadEvents()
+		for _, event := range events {
+			ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := ws.WriteJSON(event); err != nil {
+				fw.Close()
+				return
+			}
+		}
+		if err != nil {
+			if err == errWatchRemoved {
+				fw.Close()
+			}
+			ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, err.Error()))
+			break
+		}
+	}
+	log.Printf("file watch %s finished", path)
+}
@@ -0,0 +1,52 @@
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileWatcherRemoved(t *testing.T) {
+	root, err := ioutil.TempDir("", "atx-watch")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "watched")
+	assert.NoError(t, os.Mkdir(dir, 0755))
+
+	fw, err := newFileWatcher(false)
+	assert.NoError(t, err)
+	defer fw.Close()
+	assert.NoError(t, fw.Add(dir))
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644))
+	assert.NoError(t, os.RemoveAll(dir))
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		var types []string
+		for {
+			events, err := fw.ReadEvents()
+			for _, event := range events {
+				types = append(types, event.Type)
+			}
+			if err != nil {
+				assert.Equal(t, errWatchRemoved, err)
+				assert.Contains(t, types, "create")
+				assert.Equal(t, "delete", types[len(types)-1])
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadEvents not returned after the watched path removed")
+	}
+}
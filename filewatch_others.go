@@ -0,0 +1,9 @@
+// +build !linux
+
+package main
+
+import "net/http"
+
+func handleFileWatch(w http.ResponseWriter, r *http.Request, path string) {
+	http.Error(w, "file watch is only supported on linux", http.StatusNotImplemented)
+}
@@ -0,0 +1,234 @@
+/*
+Handle split apks and app bundles (.apks, .xapk) install
+*/
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	pmFailureRe      = regexp.MustCompile(`Failure \[([\w_ ]+)\]`)
+	installSessionRe = regexp.MustCompile(`\[(\d+)\]`)
+)
+
+// pmError extract "Failure [INSTALL_FAILED_XXX]" from pm output
+func pmError(out []byte, err error) error {
+	if err == nil {
+		err = errors.New("pm failed")
+	}
+	if matches := pmFailureRe.FindStringSubmatch(string(out)); len(matches) > 0 {
+		return errors.Wrap(err, matches[0])
+	}
+	return errors.Wrap(err, strings.TrimSpace(string(out)))
+}
+
+var knownABIs = map[string]bool{
+	"armeabi":     true,
+	"armeabi_v7a": true,
+	"arm64_v8a":   true,
+	"x86":         true,
+	"x86_64":      true,
+	"mips":        true,
+	"mips64":      true,
+}
+
+// deviceABIs return supported abis like arm64_v8a, the same format as split names
+func deviceABIs() []string {
+	abilist := getProperty("ro.product.cpu.abilist")
+	if abilist == "" {
+		abilist = getProperty("ro.product.cpu.abi")
+	}
+	var abis []string
+	for _, abi := range strings.Split(abilist, ",") {
+		if abi = strings.TrimSpace(abi); abi != "" {
+			abis = append(abis, strings.Replace(abi, "-", "_", -1))
+		}
+	}
+	return abis
+}
+
+// splitABI return abi of the config split, eg: config.arm64_v8a.apk(xapk), base-arm64_v8a.apk(bundletool)
+func splitABI(name string) string {
+	base := strings.TrimSuffix(path.Base(name), ".apk")
+	for _, sep := range []string{".", "-"} {
+		if i := strings.LastIndex(base, sep); i >= 0 && knownABIs[base[i+1:]] {
+			return base[i+1:]
+		}
+	}
+	return ""
+}
+
+// isAPKBundle check if file is a zip of apks instead of an apk
+func isAPKBundle(filename string) bool {
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		return false
+	}
+	defer zr.Close()
+	hasAPK := false
+	for _, f := range zr.File {
+		if f.Name == "AndroidManifest.xml" {
+			return false
+		}
+		if strings.HasSuffix(f.Name, ".apk") {
+			hasAPK = true
+		}
+	}
+	return hasAPK
+}
+
+// selectBundleAPKs choose apks to install from names in bundle
+// .apks made by bundletool keeps splits in splits/, .xapk keeps them in the root
+// abi splits which the device not support are ignored
+func selectBundleAPKs(names []string, abis []string) []string {
+	var apks, splits []string
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".apk") {
+			continue
+		}
+		if strings.HasPrefix(name, "splits/") {
+			splits = append(splits, name)
+		} else if !strings.Contains(name, "/") {
+			apks = append(apks, name)
+		}
+	}
+	if len(splits) > 0 {
+		apks = splits
+	}
+	supported := make(map[string]bool, len(abis))
+	for _, abi := range abis {
+		supported[abi] = true
+	}
+	selected := make([]string, 0, len(apks))
+	for _, name := range apks {
+		if abi := splitABI(name); abi != "" && len(abis) > 0 && !supported[abi] {
+			continue
+		}
+		selected = append(selected, name)
+	}
+	sort.Strings(selected)
+	return selected
+}
+
+// extractAPKBundle extract selected apks into dir, obb files(Android/obb/...) of xapk are extracted into obbRoot
+func extractAPKBundle(filename, dir, obbRoot string, abis []string) (apks []string, err error) {
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	names := make([]string, 0, len(zr.File))
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	selected := make(map[string]bool)
+	for _, name := range selectBundleAPKs(names, abis) {
+		selected[name] = true
+	}
+	if len(selected) == 0 {
+		return nil, errors.New("no apk found in bundle")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		var dst string
+		switch {
+		case selected[f.Name]:
+			dst = filepath.Join(dir, strconv.Itoa(len(apks))+".apk")
+			apks = append(apks, dst)
+		case strings.HasPrefix(f.Name, "Android/obb/") && !strings.HasSuffix(f.Name, "/"):
+			rel, err := cleanSyncPath(f.Name)
+			if err != nil {
+				return nil, err
+			}
+			dst = filepath.Join(obbRoot, rel)
+			os.MkdirAll(filepath.Dir(dst), 0755)
+		default:
+			continue
+		}
+		if err := extractZipFile(f, dst); err != nil {
+			return nil, err
+		}
+	}
+	return apks, nil
+}
+
+func extractZipFile(f *zip.File, dst string) error {
+	rd, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	wr, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer wr.Close()
+	_, err = io.Copy(wr, rd)
+	return err
+}
+
+type splitInstallProgress struct {
+	TotalSize  int64  `json:"totalSize"`
+	CopiedSize int64  `json:"copiedSize"`
+	Current    string `json:"current,omitempty"`
+}
+
+// installSplitAPKs install apks of the same package in one pm install session
+func installSplitAPKs(apks []string, progress *splitInstallProgress, extraArgs ...string) error {
+	sizes := make([]int64, len(apks))
+	var total int64
+	for i, apk := range apks {
+		fi, err := os.Stat(apk)
+		if err != nil {
+			return err
+		}
+		sizes[i] = fi.Size()
+		total += fi.Size()
+	}
+	progress.TotalSize, progress.CopiedSize = total, 0
+
+	sdk, _ := strconv.Atoi(getProperty("ro.build.version.sdk"))
+	cmds := []string{"pm", "install-create", "-d", "-r"}
+	if sdk >= 23 { // android 6.0
+		cmds = append(cmds, "-g")
+	}
+	cmds = append(append(cmds, extraArgs...), "-S", strconv.FormatInt(total, 10))
+	out, err := runShell(cmds...)
+	matches := installSessionRe.FindStringSubmatch(string(out))
+	if err != nil || matches == nil {
+		return pmError(out, err)
+	}
+	session := matches[1]
+
+	for i, apk := range apks {
+		progress.Current = filepath.Base(apk)
+		out, err := runShell("pm", "install-write", "-S", strconv.FormatInt(sizes[i], 10),
+			session, fmt.Sprintf("split_%d.apk", i), apk)
+		if err != nil || !strings.Contains(string(out), "Success") {
+			runShell("pm", "install-abandon", session)
+			return pmError(out, err)
+		}
+		progress.CopiedSize += sizes[i]
+	}
+	progress.Current = ""
+	out, err = runShell("pm", "install-commit", session)
+	if err != nil || !strings.Contains(string(out), "Success") {
+		return pmError(out, err)
+	}
+	return nil
+}
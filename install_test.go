@@ -0,0 +1,63 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectBundleAPKs(t *testing.T) {
+	abis := []string{"arm64_v8a", "armeabi_v7a"}
+	// xapk
+	assert.Equal(t, []string{"com.example.apk", "config.arm64_v8a.apk", "config.xxhdpi.apk"},
+		selectBundleAPKs([]string{"manifest.json", "icon.png", "com.example.apk", "config.x86.apk",
+			"config.arm64_v8a.apk", "config.xxhdpi.apk", "Android/obb/com.example/main.1.com.example.obb"}, abis))
+	// bundletool apks
+	assert.Equal(t, []string{"splits/base-armeabi_v7a.apk", "splits/base-master.apk"},
+		selectBundleAPKs([]string{"toc.pb", "splits/base-master.apk", "splits/base-x86_64.apk",
+			"splits/base-armeabi_v7a.apk", "standalones/standalone-x86.apk"}, abis))
+	// unknown device abi, keep all
+	assert.Len(t, selectBundleAPKs([]string{"base.apk", "config.x86.apk"}, nil), 2)
+
+	assert.Equal(t, "x86_64", splitABI("splits/base-x86_64.apk"))
+	assert.Equal(t, "", splitABI("base-master.apk"))
+}
+
+func TestExtractAPKBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atx-bundle")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	bundle := filepath.Join(dir, "app.xapk")
+	f, err := os.Create(bundle)
+	assert.NoError(t, err)
+	zw := zip.NewWriter(f)
+	for _, name := range []string{"manifest.json", "base.apk", "config.x86.apk", "config.arm64_v8a.apk", "Android/obb/com.example/main.obb"} {
+		wr, _ := zw.Create(name)
+		wr.Write([]byte(name))
+	}
+	zw.Close()
+	f.Close()
+
+	assert.True(t, isAPKBundle(bundle))
+	assert.False(t, isAPKBundle(filepath.Join(dir, "not-exists.apk")))
+
+	apks, err := extractAPKBundle(bundle, filepath.Join(dir, "splits"), filepath.Join(dir, "sdcard"), []string{"arm64_v8a"})
+	assert.NoError(t, err)
+	assert.Len(t, apks, 2)
+	data, _ := ioutil.ReadFile(apks[1])
+	assert.Equal(t, "config.arm64_v8a.apk", string(data))
+	data, _ = ioutil.ReadFile(filepath.Join(dir, "sdcard/Android/obb/com.example/main.obb"))
+	assert.Equal(t, "Android/obb/com.example/main.obb", string(data))
+}
+
+func TestPmError(t *testing.T) {
+	err := pmError([]byte("Failure [INSTALL_FAILED_VERSION_DOWNGRADE]\n"), errors.New("exit status 1"))
+	assert.Contains(t, err.Error(), "INSTALL_FAILED_VERSION_DOWNGRADE")
+	assert.Error(t, pmError([]byte("Error: unknown"), nil))
+}
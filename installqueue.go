@@ -0,0 +1,280 @@
+/*
+Install queue, apks are installed one by one
+*/
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/shogo82148/androidbinary/apk"
+)
+
+const (
+	installStateQueued      = "queued"
+	installStateDownloading = "downloading"
+	installStateVerifying   = "verifying"
+	installStateInstalling  = "installing"
+	installStateDone        = "done"
+	installStateFailed      = "failed"
+)
+
+// failure codes besides INSTALL_FAILED_* and INSTALL_PARSE_FAILED_* reported by pm
+const (
+	installCodeDownloadFailed = "DOWNLOAD_FAILED"
+	installCodeExtractFailed  = "EXTRACT_FAILED"
+	installCodeParseFailed    = "PARSE_FAILED"
+	installCodeCanceled       = "CANCELED"
+	installCodeUnknown        = "UNKNOWN"
+)
+
+type installRetryPolicy int
+
+const (
+	retryNone       installRetryPolicy = iota
+	retryLater                         // transient error, retry after a while
+	retryUninstall                     // uninstall the installed package first
+	retryTrimCaches                    // free storage first
+	retryAllowTest                     // pm install -t
+)
+
+var installRetryPolicies = map[string]installRetryPolicy{
+	"INSTALL_FAILED_PERMISSION_MODEL_DOWNGRADE": retryUninstall,
+	"INSTALL_FAILED_UPDATE_INCOMPATIBLE":        retryUninstall,
+	"INSTALL_FAILED_VERSION_DOWNGRADE":          retryUninstall,
+	"INSTALL_FAILED_INSUFFICIENT_STORAGE":       retryTrimCaches,
+	"INSTALL_FAILED_TEST_ONLY":                  retryAllowTest,
+	"INSTALL_FAILED_INTERNAL_ERROR":             retryLater,
+	"INSTALL_FAILED_ABORTED":                    retryLater,
+	"INSTALL_FAILED_UID_CHANGED":                retryLater,
+	"INSTALL_FAILED_MEDIA_UNAVAILABLE":          retryLater,
+}
+
+const (
+	installMaxRetries = 3
+	installRetryDelay = 5 * time.Second
+)
+
+var installFailureRe = regexp.MustCompile(`INSTALL_(PARSE_)?FAILED_[A-Z_]+`)
+
+// installFailureCode return code like INSTALL_FAILED_VERSION_DOWNGRADE, UNKNOWN if not found
+func installFailureCode(err error) string {
+	if code := installFailureRe.FindString(err.Error()); code != "" {
+		return code
+	}
+	return installCodeUnknown
+}
+
+// installWithRetry call install until success or no retry policy matched
+// install will be called with extra arguments for pm install, eg: -t
+func installWithRetry(packageName string, install func(extraArgs []string) error, onRetry func(code string)) error {
+	var extraArgs []string
+	applied := make(map[installRetryPolicy]bool)
+	var err error
+	for retries := 0; ; retries++ {
+		if err = install(extraArgs); err == nil {
+			return nil
+		}
+		code := installFailureCode(err)
+		policy := installRetryPolicies[code]
+		if policy == retryNone || retries >= installMaxRetries || (applied[policy] && policy != retryLater) {
+			return err
+		}
+		applied[policy] = true
+		log.Printf("install %s failed: %s, retry", packageName, code)
+		switch policy {
+		case retryLater:
+			time.Sleep(time.Duration(retries+1) * installRetryDelay)
+		case retryUninstall:
+			runShell("pm", "uninstall", packageName)
+		case retryTrimCaches:
+			runShell("pm", "trim-caches", "1000G") // as much as possible
+		case retryAllowTest:
+			extraArgs = append(extraArgs, "-t")
+		}
+		if onRetry != nil {
+			onRetry(code)
+		}
+	}
+}
+
+type installJob struct {
+	key      string
+	state    *BackgroundState
+	url      string   // download before installing if not empty
+	files    []string // apks or bundle
+	canceled bool
+}
+
+// InstallQueue install apks one by one, pm install in parallel is slow and easy to fail
+type InstallQueue struct {
+	jobs    chan *installJob
+	mu      sync.Mutex
+	pending map[string]*installJob
+}
+
+var installQueue = newInstallQueue(100)
+
+func newInstallQueue(size int) *InstallQueue {
+	q := &InstallQueue{
+		jobs:    make(chan *installJob, size),
+		pending: make(map[string]*installJob),
+	}
+	go q.run()
+	return q
+}
+
+var errInstallQueueFull = errors.New("install queue is full")
+
+// Submit queue the apk install, url is downloaded first if files is empty
+func (q *InstallQueue) Submit(key string, url string, files ...string) error {
+	state := background.Get(key)
+	if state == nil {
+		return errors.New("not found key: " + key)
+	}
+	job := &installJob{key: key, state: state, url: url, files: files}
+	state.Type = "install"
+	state.setState(installStateQueued)
+	state.Message = "queued"
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case q.jobs <- job:
+		q.pending[key] = job
+		return nil
+	default:
+		background.sm.Delete(key)
+		return errInstallQueueFull
+	}
+}
+
+// Cancel the install which is still queued
+func (q *InstallQueue) Cancel(key string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.pending[key]
+	if !ok {
+		return false
+	}
+	job.canceled = true
+	delete(q.pending, key)
+	installFailed(job.state, installCodeCanceled, "canceled", errors.New("install canceled"))
+	return true
+}
+
+func (q *InstallQueue) run() {
+	for job := range q.jobs {
+		q.mu.Lock()
+		canceled := job.canceled
+		delete(q.pending, job.key)
+		q.mu.Unlock()
+		if canceled {
+			removeFiles(job.files)
+		} else {
+			q.process(job)
+		}
+		background.delayDelete(job.key)
+	}
+}
+
+func (q *InstallQueue) process(job *installJob) {
+	state := job.state
+	files := job.files
+	if job.url != "" {
+		state.setState(installStateDownloading)
+		state.Message = "downloading"
+		dst := TempFileName("/sdcard/tmp", ".apk")
+		files = append(files, dst)
+		state.wg.Add(1)
+		if err := background.doHTTPDownload(job.key, job.url, dst, 0644); err != nil {
+			removeFiles(files)
+			if isCanceled(state) {
+				installFailed(state, installCodeCanceled, "canceled", err)
+			} else {
+				installFailed(state, installCodeDownloadFailed, "http download error", err)
+			}
+			return
+		}
+	}
+	installAPKWithState(state, files...)
+}
+
+func installFailed(state *BackgroundState, code string, message string, err error) {
+	state.setState(installStateFailed)
+	state.Code = code
+	state.Message = message
+	state.Error = err.Error()
+}
+
+func removeFiles(files []string) {
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
+// installAPKWithState parse and install apks, the progress is updated into state
+// multiple apks or an apk bundle(.apks, .xapk) are installed as split apks
+func installAPKWithState(state *BackgroundState, files ...string) {
+	defer removeFiles(files) // release sdcard space
+
+	state.setState(installStateVerifying)
+	apks := files
+	if len(files) == 1 && isAPKBundle(files[0]) {
+		state.Message = "extracting bundle"
+		dir := TempFileName("/sdcard/tmp", "")
+		defer os.RemoveAll(dir)
+		var err error
+		if apks, err = extractAPKBundle(files[0], dir, "/sdcard", deviceABIs()); err != nil {
+			installFailed(state, installCodeExtractFailed, "extract bundle error", err)
+			return
+		}
+	}
+
+	state.Message = "apk parsing"
+	var packageName string
+	var er error
+	for _, file := range apks { // config splits may not be parsable, any of them is ok
+		pkg, err := apk.OpenFile(file)
+		if err != nil {
+			er = err
+			continue
+		}
+		packageName = pkg.PackageName()
+		pkg.Close()
+		break
+	}
+	if packageName == "" {
+		installFailed(state, installCodeParseFailed, "androidbinary parse apk error", er)
+		return
+	}
+	state.PackageName = packageName
+
+	state.setState(installStateInstalling)
+	state.Message = "installing"
+	onRetry := func(code string) {
+		state.Retries++
+		state.Message = "retry installing after " + code
+	}
+	var err error
+	if len(apks) == 1 {
+		err = installWithRetry(packageName, func(extraArgs []string) error {
+			return installAPK(apks[0], extraArgs...)
+		}, onRetry)
+	} else {
+		progress := &splitInstallProgress{}
+		state.setProgress(progress)
+		err = installWithRetry(packageName, func(extraArgs []string) error {
+			return installSplitAPKs(apks, progress, extraArgs...)
+		}, onRetry)
+	}
+	if err != nil {
+		installFailed(state, installFailureCode(err), "error install", err)
+		return
+	}
+	state.setState(installStateDone)
+	state.Message = "success installed"
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstallFailureCode(t *testing.T) {
+	assert.Equal(t, "INSTALL_FAILED_VERSION_DOWNGRADE", installFailureCode(errors.New("Failure [INSTALL_FAILED_VERSION_DOWNGRADE]: exit status 1")))
+	assert.Equal(t, "INSTALL_PARSE_FAILED_NO_CERTIFICATES", installFailureCode(errors.New("Failure [INSTALL_PARSE_FAILED_NO_CERTIFICATES: Package has no certificates]")))
+	assert.Equal(t, installCodeUnknown, installFailureCode(errors.New("exit status 1")))
+}
+
+func TestInstallWithRetry(t *testing.T) {
+	var calls [][]string
+	err := installWithRetry("com.example", func(extraArgs []string) error {
+		calls = append(calls, extraArgs)
+		if len(extraArgs) == 0 {
+			return errors.New("Failure [INSTALL_FAILED_TEST_ONLY]")
+		}
+		return nil
+	}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{nil, {"-t"}}, calls)
+
+	// no retry policy
+	calls = nil
+	err = installWithRetry("com.example", func(extraArgs []string) error {
+		calls = append(calls, extraArgs)
+		return errors.New("Failure [INSTALL_FAILED_INVALID_APK]")
+	}, nil)
+	assert.Error(t, err)
+	assert.Len(t, calls, 1)
+	// the permission is defined by another package, uninstall this one does not help
+	assert.Equal(t, retryNone, installRetryPolicies["INSTALL_FAILED_DUPLICATE_PERMISSION"])
+
+	// the same policy is not applied twice
+	calls = nil
+	retries := 0
+	err = installWithRetry("com.example", func(extraArgs []string) error {
+		calls = append(calls, extraArgs)
+		return errors.New("Failure [INSTALL_FAILED_TEST_ONLY]")
+	}, func(code string) {
+		retries++
+	})
+	assert.Error(t, err)
+	assert.Len(t, calls, 2)
+	assert.Equal(t, 1, retries)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	shellquote "github.com/kballard/go-shellquote"
+)
+
+var (
+	componentRe = regexp.MustCompile(`^[\w.]+/[\w.$]+$`)
+	// flags without value of am start, eg: -W -S --activity-clear-task
+	amStartFlagRe = regexp.MustCompile(`^(-W|-S|-D|--activity-[a-z-]+)$`)
+)
+
+type intentExtra struct {
+	Key   string      `json:"key"`
+	Type  string      `json:"type"` // string, int, long, float, bool, uri, component, null, string-array, int-array, empty means guess from value
+	Value interface{} `json:"value"`
+}
+
+type intentRequest struct {
+	Type       string        `json:"type"` // activity(default), broadcast, service
+	Action     string        `json:"action"`
+	Component  string        `json:"component"` // com.example/.MainActivity
+	Data       string        `json:"data"`
+	MimeType   string        `json:"mimeType"`
+	Categories []string      `json:"categories"`
+	Flags      int           `json:"flags"`
+	Extras     []intentExtra `json:"extras"`
+	Wait       bool          `json:"wait"` // activity only, am start -W
+	Stop       bool          `json:"stop"` // activity only, am start -S
+}
+
+var amExtraOptions = map[string]string{
+	"string":       "--es",
+	"int":          "--ei",
+	"long":         "--el",
+	"float":        "--ef",
+	"bool":         "--ez",
+	"uri":          "--eu",
+	"component":    "--ecn",
+	"null":         "--esn",
+	"string-array": "--esa",
+	"int-array":    "--eia",
+}
+
+// guessExtraType from json value
+func guessExtraType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case float64:
+		if v != math.Trunc(v) {
+			return "float"
+		}
+		if v > math.MaxInt32 || v < math.MinInt32 {
+			return "long"
+		}
+		return "int"
+	case []interface{}:
+		for _, item := range v {
+			if _, ok := item.(float64); !ok {
+				return "string-array"
+			}
+		}
+		return "int-array"
+	default:
+		return "string"
+	}
+}
+
+func formatExtraValue(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			// comma is the separator of array items
+			items = append(items, strings.Replace(formatExtraValue(item), ",", `\,`, -1))
+		}
+		return strings.Join(items, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// amArgs build arguments for am, eg: am start -W -a android.intent.action.VIEW -d http://example.com
+func (req intentRequest) amArgs() ([]string, error) {
+	args := []string{"am"}
+	switch req.Type {
+	case "", "activity":
+		args = append(args, "start")
+		if req.Wait {
+			args = append(args, "-W")
+		}
+		if req.Stop {
+			args = append(args, "-S")
+		}
+	case "broadcast":
+		args = append(args, "broadcast")
+	case "service":
+		args = append(args, "startservice")
+	default:
+		return nil, errors.New("unknown intent type: " + req.Type)
+	}
+	if req.Action == "" && req.Component == "" {
+		return nil, errors.New("action or component is required")
+	}
+	if req.Action != "" {
+		args = append(args, "-a", req.Action)
+	}
+	if req.Data != "" {
+		args = append(args, "-d", req.Data)
+	}
+	if req.MimeType != "" {
+		args = append(args, "-t", req.MimeType)
+	}
+	for _, category := range req.Categories {
+		args = append(args, "-c", category)
+	}
+	if req.Flags != 0 {
+		args = append(args, "-f", strconv.Itoa(req.Flags))
+	}
+	for _, extra := range req.Extras {
+		if extra.Key == "" {
+			return nil, errors.New("extra key is required")
+		}
+		extraType := extra.Type
+		if extraType == "" {
+			extraType = guessExtraType(extra.Value)
+		}
+		option, ok := amExtraOptions[extraType]
+		if !ok {
+			return nil, errors.New("unknown extra type: " + extraType)
+		}
+		if extraType == "null" {
+			args = append(args, option, extra.Key)
+			continue
+		}
+		args = append(args, option, extra.Key, formatExtraValue(extra.Value))
+	}
+	if req.Component != "" {
+		if !componentRe.MatchString(req.Component) {
+			return nil, errors.New("invalid component: " + req.Component)
+		}
+		args = append(args, "-n", req.Component)
+	}
+	return args, nil
+}
+
+// amStartFlags split flags given by user, only known flags of am start are allowed
+func amStartFlags(flags string) ([]string, error) {
+	args := strings.Fields(flags)
+	for _, arg := range args {
+		if !amStartFlagRe.MatchString(arg) {
+			return nil, errors.New("unsupported am start flag: " + arg)
+		}
+	}
+	return args, nil
+}
+
+type amResult struct {
+	Success         bool   `json:"success"`
+	Command         string `json:"command"`
+	Output          string `json:"output"`
+	Error           string `json:"error,omitempty"`
+	Warning         string `json:"warning,omitempty"`
+	Status          string `json:"status,omitempty"`   // am start -W, ok or timeout
+	Activity        string `json:"activity,omitempty"` // am start -W
+	ThisTime        int    `json:"thisTime,omitempty"` // milliseconds
+	TotalTime       int    `json:"totalTime,omitempty"`
+	WaitTime        int    `json:"waitTime,omitempty"`
+	BroadcastResult *int   `json:"broadcastResult,omitempty"`
+}
+
+// parseAmOutput parse am output, am exit with 0 even if activity not started
+func parseAmOutput(output string) amResult {
+	result := amResult{Success: true, Output: output}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		key, value := line, ""
+		if i := strings.Index(line, ":"); i > 0 {
+			key, value = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		switch key {
+		case "Error":
+			result.Success = false
+			if result.Error == "" {
+				result.Error = value
+			}
+		case "Warning":
+			result.Warning = value
+		case "Status":
+			result.Status = value
+		case "Activity":
+			result.Activity = value
+		case "ThisTime":
+			result.ThisTime, _ = strconv.Atoi(value)
+		case "TotalTime":
+			result.TotalTime, _ = strconv.Atoi(value)
+		case "WaitTime":
+			result.WaitTime, _ = strconv.Atoi(value)
+		case "Broadcast completed":
+			// Broadcast completed: result=0
+			var code int
+			if _, err := fmt.Sscanf(value, "result=%d", &code); err == nil {
+				result.BroadcastResult = &code
+			}
+		}
+	}
+	return result
+}
+
+func startIntent(req intentRequest) (amResult, error) {
+	args, err := req.amArgs()
+	if err != nil {
+		return amResult{}, err
+	}
+	output, err := Command{
+		Args:       args,
+		Shell:      true,
+		ShellQuote: true,
+		Timeout:    time.Minute,
+	}.CombinedOutput()
+	result := parseAmOutput(string(output))
+	result.Command = shellquote.Join(args...)
+	if err != nil && result.Error == "" {
+		result.Success = false
+		result.Error = err.Error()
+	}
+	return result, nil
+}
+
+func handleIntent(w http.ResponseWriter, r *http.Request) {
+	var req intentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	result, err := startIntent(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Success {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(result)
+}
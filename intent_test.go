@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntentAmArgs(t *testing.T) {
+	var req intentRequest
+	err := json.Unmarshal([]byte(`{
+		"action": "android.intent.action.VIEW",
+		"data": "https://example.com/?a=1&b=2",
+		"categories": ["android.intent.category.BROWSABLE"],
+		"component": "com.example/.MainActivity",
+		"wait": true,
+		"extras": [
+			{"key": "name", "value": "hello world"},
+			{"key": "count", "value": 3},
+			{"key": "ts", "value": 1500000000000},
+			{"key": "ratio", "value": 0.5},
+			{"key": "debug", "value": true},
+			{"key": "tags", "value": ["a,b", "c"]},
+			{"key": "ids", "value": [1, 2]},
+			{"key": "empty", "value": null},
+			{"key": "port", "type": "string", "value": 8080}
+		]
+	}`), &req)
+	assert.NoError(t, err)
+	args, err := req.amArgs()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"am", "start", "-W",
+		"-a", "android.intent.action.VIEW",
+		"-d", "https://example.com/?a=1&b=2",
+		"-c", "android.intent.category.BROWSABLE",
+		"--es", "name", "hello world",
+		"--ei", "count", "3",
+		"--el", "ts", "1500000000000",
+		"--ef", "ratio", "0.5",
+		"--ez", "debug", "true",
+		"--esa", "tags", `a\,b,c`,
+		"--eia", "ids", "1,2",
+		"--esn", "empty",
+		"--es", "port", "8080",
+		"-n", "com.example/.MainActivity"}, args)
+
+	args, err = intentRequest{Type: "broadcast", Action: "com.example.PING"}.amArgs()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"am", "broadcast", "-a", "com.example.PING"}, args)
+
+	_, err = intentRequest{Type: "service"}.amArgs()
+	assert.Error(t, err)
+	_, err = intentRequest{Type: "provider", Action: "x"}.amArgs()
+	assert.Error(t, err)
+	_, err = intentRequest{Component: "com.example/.Main; reboot"}.amArgs()
+	assert.Error(t, err)
+	_, err = intentRequest{Action: "x", Extras: []intentExtra{{Key: "a", Type: "double", Value: 1}}}.amArgs()
+	assert.Error(t, err)
+}
+
+func TestParseAmOutput(t *testing.T) {
+	result := parseAmOutput(`Starting: Intent { cmp=com.example/.MainActivity }
+Status: ok
+Activity: com.example/.MainActivity
+ThisTime: 350
+TotalTime: 352
+WaitTime: 371
+Complete
+`)
+	assert.True(t, result.Success)
+	assert.Equal(t, "ok", result.Status)
+	assert.Equal(t, "com.example/.MainActivity", result.Activity)
+	assert.Equal(t, 350, result.ThisTime)
+	assert.Equal(t, 352, result.TotalTime)
+	assert.Equal(t, 371, result.WaitTime)
+
+	result = parseAmOutput(`Starting: Intent { cmp=com.example/.Missing }
+Error type 3
+Error: Activity class {com.example/com.example.Missing} does not exist.
+`)
+	assert.False(t, result.Success)
+	assert.Equal(t, "Activity class {com.example/com.example.Missing} does not exist.", result.Error)
+
+	result = parseAmOutput(`Broadcasting: Intent { act=com.example.PING flg=0x400000 }
+Broadcast completed: result=0
+`)
+	assert.True(t, result.Success)
+	if assert.NotNil(t, result.BroadcastResult) {
+		assert.Equal(t, 0, *result.BroadcastResult)
+	}
+}
+
+func TestAmStartFlags(t *testing.T) {
+	args, err := amStartFlags("-W  -S --activity-clear-task")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-W", "-S", "--activity-clear-task"}, args)
+
+	_, err = amStartFlags("-W; reboot")
+	assert.Error(t, err)
+	_, err = amStartFlags("-W $(reboot)")
+	assert.Error(t, err)
+	_, err = amStartFlags("--user 0")
+	assert.Error(t, err)
+}
@@ -0,0 +1,219 @@
+/*
+Handle async shell commands
+*/
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/codeskyblue/kexec"
+)
+
+const (
+	defaultJobTimeout  = 10 * time.Minute
+	jobOutputMaxSize   = 1 << 20 // 1M for each stdout and stderr
+	jobFinishedKeepFor = 10 * time.Minute
+)
+
+var jobManager = newJobManager()
+
+// limitedBuffer is safe for concurrent use, data beyond max size is dropped
+type limitedBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(data []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if remain := b.max - b.buf.Len(); remain < len(data) {
+		b.truncated = true
+		if remain > 0 {
+			b.buf.Write(data[:remain])
+		}
+		return len(data), nil
+	}
+	return b.buf.Write(data)
+}
+
+func (b *limitedBuffer) Truncated() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.truncated
+}
+
+func (b *limitedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+type Job struct {
+	Id        string    `json:"id"`
+	Command   string    `json:"command"`
+	Dir       string    `json:"dir,omitempty"`
+	Env       []string  `json:"env,omitempty"`
+	Timeout   float64   `json:"timeout"` // seconds
+	State     string    `json:"state"`   // running, finished, killed, timeout, error
+	ExitCode  *int      `json:"exitCode"`
+	Error     string    `json:"error,omitempty"`
+	StartedAt time.Time `json:"startedAt"`
+	Duration  float64   `json:"duration"` // seconds
+	Stdout    string    `json:"stdout"`
+	Stderr    string    `json:"stderr"`
+	Truncated bool      `json:"truncated,omitempty"`
+
+	mu         sync.Mutex
+	cmd        *kexec.KCommand
+	stdout     *limitedBuffer
+	stderr     *limitedBuffer
+	killed     bool
+	finishedAt time.Time
+	done       chan bool
+}
+
+// Status return a snapshot of the job which can be encoded as json
+func (j *Job) Status() *Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := &Job{
+		Id:        j.Id,
+		Command:   j.Command,
+		Dir:       j.Dir,
+		Env:       j.Env,
+		Timeout:   j.Timeout,
+		State:     j.State,
+		ExitCode:  j.ExitCode,
+		Error:     j.Error,
+		StartedAt: j.StartedAt,
+		Stdout:    j.stdout.String(),
+		Stderr:    j.stderr.String(),
+		Truncated: j.stdout.Truncated() || j.stderr.Truncated(),
+	}
+	if j.finishedAt.IsZero() {
+		status.Duration = time.Since(j.StartedAt).Seconds()
+	} else {
+		status.Duration = j.finishedAt.Sub(j.StartedAt).Seconds()
+	}
+	return status
+}
+
+// Kill the whole process group of the job
+func (j *Job) Kill() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.State != "running" {
+		return errors.New("job is not running")
+	}
+	j.killed = true
+	return j.cmd.Terminate(syscall.SIGKILL)
+}
+
+func (j *Job) wait(timeout time.Duration) {
+	var timedOut bool
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			j.mu.Lock()
+			timedOut = true
+			j.mu.Unlock()
+			j.cmd.Terminate(syscall.SIGKILL)
+		})
+		defer timer.Stop()
+	}
+	err := j.cmd.Wait()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finishedAt = time.Now()
+	if j.cmd.ProcessState != nil {
+		if ws, ok := j.cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+			exitCode := ws.ExitStatus()
+			j.ExitCode = &exitCode
+		}
+	}
+	switch {
+	case timedOut:
+		j.State = "timeout"
+	case j.killed:
+		j.State = "killed"
+	case j.ExitCode == nil && err != nil:
+		j.State = "error"
+		j.Error = err.Error()
+	default:
+		j.State = "finished"
+	}
+	close(j.done)
+}
+
+type JobManager struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+	n    int
+}
+
+func newJobManager() *JobManager {
+	return &JobManager{
+		jobs: make(map[string]*Job, 10),
+	}
+}
+
+func (m *JobManager) Get(id string) *Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.jobs[id]
+}
+
+// Start run command with sh -c in background, timeout 0 means defaultJobTimeout
+func (m *JobManager) Start(command, dir string, env []string, timeout time.Duration) (job *Job, err error) {
+	if command == "" {
+		return nil, errors.New("command is empty")
+	}
+	if timeout <= 0 {
+		timeout = defaultJobTimeout
+	}
+	cmd := kexec.CommandString(command)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	job = &Job{
+		Command: command,
+		Dir:     dir,
+		Env:     env,
+		Timeout: timeout.Seconds(),
+		State:   "running",
+		cmd:     cmd,
+		stdout:  &limitedBuffer{max: jobOutputMaxSize},
+		stderr:  &limitedBuffer{max: jobOutputMaxSize},
+		done:    make(chan bool),
+	}
+	cmd.Stdout = job.stdout
+	cmd.Stderr = job.stderr
+	job.StartedAt = time.Now()
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	m.n++
+	job.Id = strconv.Itoa(m.n)
+	m.jobs[job.Id] = job
+	m.mu.Unlock()
+
+	go func() {
+		job.wait(timeout)
+		// release finished jobs later, or memory grows forever
+		time.AfterFunc(jobFinishedKeepFor, func() {
+			m.mu.Lock()
+			delete(m.jobs, job.Id)
+			m.mu.Unlock()
+		})
+	}()
+	return job, nil
+}
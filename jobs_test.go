@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobManager(t *testing.T) {
+	m := newJobManager()
+	job, err := m.Start("echo hello; echo world >&2; exit 3", "", nil, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, job, m.Get(job.Id))
+	<-job.done
+	status := job.Status()
+	assert.Equal(t, "finished", status.State)
+	assert.Equal(t, 3, *status.ExitCode)
+	assert.Equal(t, "hello\n", status.Stdout)
+	assert.Equal(t, "world\n", status.Stderr)
+
+	job, err = m.Start("sleep 10", "", nil, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, job.Kill())
+	<-job.done
+	assert.Equal(t, "killed", job.Status().State)
+	assert.Error(t, job.Kill())
+
+	job, err = m.Start("sleep 10", "", nil, 100*time.Millisecond)
+	assert.NoError(t, err)
+	<-job.done
+	assert.Equal(t, "timeout", job.Status().State)
+
+	_, err = m.Start("", "", nil, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	launchModeCold = "cold" // process killed before launch, am start -S
+	launchModeHot  = "hot"  // process and activity kept, back to home before launch
+
+	launchMaxCount = 50
+)
+
+type launchStats struct {
+	Min    int     `json:"min"`
+	Max    int     `json:"max"`
+	Mean   float64 `json:"mean"`
+	Median float64 `json:"median"`
+	P90    int     `json:"p90"`
+}
+
+// calcLaunchStats return statistics of the values, p90 use nearest-rank method
+func calcLaunchStats(values []int) launchStats {
+	if len(values) == 0 {
+		return launchStats{}
+	}
+	sorted := append([]int(nil), values...)
+	sort.Ints(sorted)
+	n := len(sorted)
+	sum := 0
+	for _, v := range sorted {
+		sum += v
+	}
+	stats := launchStats{
+		Min:  sorted[0],
+		Max:  sorted[n-1],
+		Mean: float64(sum) / float64(n),
+		P90:  sorted[int(math.Ceil(0.9*float64(n)))-1],
+	}
+	if n%2 == 1 {
+		stats.Median = float64(sorted[n/2])
+	} else {
+		stats.Median = float64(sorted[n/2-1]+sorted[n/2]) / 2
+	}
+	return stats
+}
+
+type launchTime struct {
+	ThisTime  int `json:"thisTime"` // milliseconds
+	TotalTime int `json:"totalTime"`
+	WaitTime  int `json:"waitTime"`
+}
+
+type launchReport struct {
+	PackageName string       `json:"packageName"`
+	Activity    string       `json:"activity"`
+	Mode        string       `json:"mode"`
+	Count       int          `json:"count"`
+	Launches    []launchTime `json:"launches"`
+	ThisTime    launchStats  `json:"thisTime"`
+	TotalTime   launchStats  `json:"totalTime"`
+	WaitTime    launchStats  `json:"waitTime"`
+}
+
+func newLaunchReport(packageName, activity, mode string, launches []launchTime) *launchReport {
+	var thisTimes, totalTimes, waitTimes []int
+	for _, l := range launches {
+		thisTimes = append(thisTimes, l.ThisTime)
+		totalTimes = append(totalTimes, l.TotalTime)
+		waitTimes = append(waitTimes, l.WaitTime)
+	}
+	return &launchReport{
+		PackageName: packageName,
+		Activity:    activity,
+		Mode:        mode,
+		Count:       len(launches),
+		Launches:    launches,
+		ThisTime:    calcLaunchStats(thisTimes),
+		TotalTime:   calcLaunchStats(totalTimes),
+		WaitTime:    calcLaunchStats(waitTimes),
+	}
+}
+
+func checkLaunchOptions(mode string, count int) error {
+	if mode != launchModeCold && mode != launchModeHot {
+		return errors.New("mode should be cold or hot")
+	}
+	if count < 1 || count > launchMaxCount {
+		return fmt.Errorf("count should be between 1 and %d", launchMaxCount)
+	}
+	return nil
+}
+
+// measureLaunchTime launch the activity count times with am start -W
+func measureLaunchTime(packageName, activity, mode string, count int, interval time.Duration) (*launchReport, error) {
+	req := intentRequest{
+		Component: packageName + "/" + activity,
+		Wait:      true,
+		Stop:      mode == launchModeCold,
+	}
+	launches := make([]launchTime, 0, count)
+	// the first launch of hot mode is only used to start the process
+	for i := 0; len(launches) < count; i++ {
+		if i > 0 {
+			if mode == launchModeHot {
+				runShell("input", "keyevent", "KEYCODE_HOME")
+			}
+			time.Sleep(interval)
+		}
+		result, err := startIntent(req)
+		if err != nil {
+			return nil, err
+		}
+		if !result.Success {
+			return nil, fmt.Errorf("launch #%d: %s", i+1, result.Error)
+		}
+		if result.Status != "ok" {
+			return nil, fmt.Errorf("launch #%d: status %s", i+1, result.Status)
+		}
+		if mode == launchModeHot && i == 0 {
+			continue
+		}
+		launches = append(launches, launchTime{
+			ThisTime:  result.ThisTime,
+			TotalTime: result.TotalTime,
+			WaitTime:  result.WaitTime,
+		})
+	}
+	return newLaunchReport(packageName, activity, mode, launches), nil
+}
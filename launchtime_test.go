@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalcLaunchStats(t *testing.T) {
+	stats := calcLaunchStats([]int{500, 300, 400, 1000, 350, 420, 380, 390, 410, 360})
+	assert.Equal(t, 300, stats.Min)
+	assert.Equal(t, 1000, stats.Max)
+	assert.Equal(t, 451.0, stats.Mean)
+	assert.Equal(t, 395.0, stats.Median)
+	assert.Equal(t, 500, stats.P90)
+
+	stats = calcLaunchStats([]int{300, 100, 200})
+	assert.Equal(t, 200.0, stats.Median)
+	assert.Equal(t, 300, stats.P90)
+
+	assert.Equal(t, launchStats{}, calcLaunchStats(nil))
+}
+
+func TestNewLaunchReport(t *testing.T) {
+	report := newLaunchReport("com.example", "com.example.MainActivity", launchModeCold, []launchTime{
+		{ThisTime: 300, TotalTime: 310, WaitTime: 330},
+		{ThisTime: 280, TotalTime: 290, WaitTime: 320},
+	})
+	assert.Equal(t, 2, report.Count)
+	assert.Equal(t, 280, report.ThisTime.Min)
+	assert.Equal(t, 300.0, report.TotalTime.Median)
+	assert.Equal(t, 330, report.WaitTime.P90)
+}
+
+func TestCheckLaunchOptions(t *testing.T) {
+	assert.NoError(t, checkLaunchOptions(launchModeCold, 1))
+	assert.NoError(t, checkLaunchOptions(launchModeHot, launchMaxCount))
+	assert.Error(t, checkLaunchOptions("warm", 5))
+	assert.Error(t, checkLaunchOptions(launchModeCold, 0))
+	assert.Error(t, checkLaunchOptions(launchModeCold, launchMaxCount+1))
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
 	"flag"
@@ -21,7 +22,6 @@ import (
 	"os/user"
 	"path"
 	"path/filepath"
-	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
@@ -36,9 +36,9 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/openatx/androidutils"
 	"github.com/openatx/atx-agent/cmdctrl"
+	"github.com/openatx/atx-server/proto"
 	"github.com/pkg/errors"
 	"github.com/rs/cors"
-	"github.com/shogo82148/androidbinary/apk"
 )
 
 var (
@@ -48,7 +48,7 @@ var (
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
 		CheckOrigin: func(r *http.Request) bool {
-			return true
+			return auth.CheckOrigin(r)
 		},
 	}
 )
@@ -190,43 +190,27 @@ func checkUiautomatorInstalled() (ok bool) {
 	return err == nil
 }
 
-func installAPK(path string) error {
+func installAPK(path string, extraArgs ...string) error {
 	// -g: grant all runtime permissions
 	// -d: allow version code downgrade
 	// -r: replace existing application
 	sdk, _ := strconv.Atoi(getProperty("ro.build.version.sdk"))
-	cmds := []string{"pm", "install", "-d", "-r", path}
+	cmds := []string{"pm", "install", "-d", "-r"}
 	if sdk >= 23 { // android 6.0
-		cmds = []string{"pm", "install", "-d", "-r", "-g", path}
+		cmds = append(cmds, "-g")
 	}
+	cmds = append(append(cmds, extraArgs...), path)
 	out, err := runShell(cmds...)
 	if err != nil {
-		matches := regexp.MustCompile(`Failure \[([\w_ ]+)\]`).FindStringSubmatch(string(out))
-		if len(matches) > 0 {
-			return errors.Wrap(err, matches[0])
-		}
-		return errors.Wrap(err, string(out))
+		return pmError(out, err)
 	}
 	return nil
 }
 
-var canFixedInstallFails = map[string]bool{
-	"INSTALL_FAILED_PERMISSION_MODEL_DOWNGRADE": true,
-	"INSTALL_FAILED_UPDATE_INCOMPATIBLE":        true,
-	"INSTALL_FAILED_VERSION_DOWNGRADE":          true,
-}
-
 func installAPKForce(path string, packageName string) error {
-	err := installAPK(path)
-	if err == nil {
-		return nil
-	}
-	errType := regexp.MustCompile(`INSTALL_FAILED_[\w_]+`).FindString(err.Error())
-	if !canFixedInstallFails[errType] {
-		return err
-	}
-	runShell("pm", "uninstall", packageName)
-	return installAPK(path)
+	return installWithRetry(packageName, func(extraArgs []string) error {
+		return installAPK(path, extraArgs...)
+	}, nil)
 }
 
 func Screenshot(filename string) (err error) {
@@ -461,18 +445,32 @@ func ServeHTTP(lis net.Listener, tunnel *TunnelProxy) error {
 
 	m.HandleFunc("/session/{pkgname}", func(w http.ResponseWriter, r *http.Request) {
 		packageName := mux.Vars(r)["pkgname"]
-		mainActivity, err := mainActivityOf(packageName)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusGone) // 410
+		if !validPackageNameRe.MatchString(packageName) {
+			http.Error(w, "invalid package name: "+packageName, http.StatusBadRequest)
 			return
 		}
 		flags := r.FormValue("flags")
 		if flags == "" {
 			flags = "-W -S" // W: wait launched, S: stop before started
 		}
+		args, err := amStartFlags(flags)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mainActivity, err := mainActivityOf(packageName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusGone) // 410
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json")
-		output, err := runShellTimeout(10*time.Second, "am", "start", flags, "-n", packageName+"/"+mainActivity)
+		output, err := Command{
+			Args:       append(append([]string{"am", "start"}, args...), "-n", packageName+"/"+mainActivity),
+			Shell:      true,
+			ShellQuote: true,
+			Timeout:    10 * time.Second,
+		}.CombinedOutput()
 		if err != nil {
 			json.NewEncoder(w).Encode(map[string]interface{}{
 				"success":      false,
@@ -489,6 +487,90 @@ func ServeHTTP(lis net.Listener, tunnel *TunnelProxy) error {
 		}
 	}).Methods("POST")
 
+	m.HandleFunc("/session/{pkgname}", func(w http.ResponseWriter, r *http.Request) {
+		packageName := mux.Vars(r)["pkgname"]
+		if !validPackageNameRe.MatchString(packageName) {
+			http.Error(w, "invalid package name: "+packageName, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		output, err := runShellTimeout(10*time.Second, "am", "force-stop", packageName)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": false,
+				"error":   err.Error(),
+				"output":  string(output),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": true,
+			"output":  string(output),
+		})
+	}).Methods("DELETE")
+
+	m.HandleFunc("/session/{pkgname}/launch-time", func(w http.ResponseWriter, r *http.Request) {
+		packageName := mux.Vars(r)["pkgname"]
+		if !validPackageNameRe.MatchString(packageName) {
+			http.Error(w, "invalid package name: "+packageName, http.StatusBadRequest)
+			return
+		}
+		activity := r.FormValue("activity")
+		if activity == "" {
+			var err error
+			if activity, err = mainActivityOf(packageName); err != nil {
+				http.Error(w, err.Error(), http.StatusGone) // 410
+				return
+			}
+		}
+		mode := r.FormValue("mode")
+		if mode == "" {
+			mode = launchModeCold
+		}
+		count := 5
+		if r.FormValue("count") != "" {
+			var err error
+			if count, err = strconv.Atoi(r.FormValue("count")); err != nil {
+				http.Error(w, "invalid count: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := checkLaunchOptions(mode, count); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		report, err := measureLaunchTime(packageName, activity, mode, count, time.Second)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}).Methods("POST")
+
+	m.HandleFunc("/apps/running", func(w http.ResponseWriter, r *http.Request) {
+		apps, err := listRunningApps()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(apps)
+	}).Methods("GET")
+
+	m.HandleFunc("/apps/foreground", func(w http.ResponseWriter, r *http.Request) {
+		app, err := currentForegroundApp()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(app)
+	}).Methods("GET")
+
+	m.HandleFunc("/intent", handleIntent).Methods("POST")
+
 	m.HandleFunc("/session/{pid:[0-9]+}:{pkgname}/{url:ping|jsonrpc/0}", func(w http.ResponseWriter, r *http.Request) {
 		pkgname := mux.Vars(r)["pkgname"]
 		pid, _ := strconv.Atoi(mux.Vars(r)["pid"])
@@ -513,6 +595,9 @@ func ServeHTTP(lis net.Listener, tunnel *TunnelProxy) error {
 	})
 
 	m.HandleFunc("/shell", func(w http.ResponseWriter, r *http.Request) {
+		if !checkPolicy(w, policy.CheckShell()) {
+			return
+		}
 		command := r.FormValue("command")
 		if command == "" {
 			command = r.FormValue("c")
@@ -531,6 +616,9 @@ func ServeHTTP(lis net.Listener, tunnel *TunnelProxy) error {
 	}).Methods("GET", "POST")
 
 	m.HandleFunc("/shell/stream", func(w http.ResponseWriter, r *http.Request) {
+		if !checkPolicy(w, policy.CheckShell()) {
+			return
+		}
 		w.Header().Set("Content-Type", "application/octet-stream")
 		command := r.FormValue("command")
 		if command == "" {
@@ -568,6 +656,66 @@ func ServeHTTP(lis net.Listener, tunnel *TunnelProxy) error {
 		log.Println("program quit")
 	})
 
+	m.HandleFunc("/exec", func(w http.ResponseWriter, r *http.Request) {
+		if !checkPolicy(w, policy.CheckShell()) {
+			return
+		}
+		handleExecWebsocket(w, r)
+	})
+
+	m.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
+		if !checkPolicy(w, policy.CheckShell()) {
+			return
+		}
+		command := r.FormValue("command")
+		if command == "" {
+			command = r.FormValue("c")
+		}
+		var timeout time.Duration
+		if r.FormValue("timeout") != "" {
+			seconds, err := strconv.ParseFloat(r.FormValue("timeout"), 64)
+			if err != nil {
+				http.Error(w, "invalid timeout: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			timeout = time.Duration(seconds * float64(time.Second))
+		}
+		r.ParseForm()
+		job, err := jobManager.Start(command, r.FormValue("dir"), r.Form["env"], timeout)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(job.Status())
+	}).Methods("POST")
+
+	m.HandleFunc("/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		job := jobManager.Get(mux.Vars(r)["id"])
+		if job == nil {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		json.NewEncoder(w).Encode(job.Status())
+	}).Methods("GET")
+
+	m.HandleFunc("/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		job := jobManager.Get(mux.Vars(r)["id"])
+		if job == nil {
+			http.Error(w, "job not found", http.StatusNotFound)
+			return
+		}
+		if err := job.Kill(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		<-job.done
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		json.NewEncoder(w).Encode(job.Status())
+	}).Methods("DELETE")
+
 	m.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
 		log.Println("stop all service")
 		service.StopAll()
@@ -599,10 +747,211 @@ func ServeHTTP(lis net.Listener, tunnel *TunnelProxy) error {
 	}).Methods("DELETE")
 
 	m.HandleFunc("/raw/{filepath:.*}", func(w http.ResponseWriter, r *http.Request) {
-		filepath := mux.Vars(r)["filepath"]
+		filepath, err := policy.CheckRead(mux.Vars(r)["filepath"])
+		if !checkPolicy(w, err) {
+			return
+		}
 		http.ServeFile(w, r, filepath)
 	})
 
+	m.HandleFunc("/files/watch", func(w http.ResponseWriter, r *http.Request) { // must before /files/{path}
+		path := r.FormValue("path")
+		if path == "" {
+			http.Error(w, "path is required", http.StatusBadRequest)
+			return
+		}
+		path, err := policy.CheckRead(path)
+		if !checkPolicy(w, err) {
+			return
+		}
+		handleFileWatch(w, r, path)
+	})
+
+	m.HandleFunc("/files/{path:.*}", func(w http.ResponseWriter, r *http.Request) {
+		path, err := policy.CheckRead(requestPath(r, "path"))
+		if !checkPolicy(w, err) {
+			return
+		}
+		info, err := statFile(path)
+		if err != nil {
+			http.Error(w, err.Error(), fileErrorStatus(err))
+			return
+		}
+		if _, ok := r.URL.Query()["stat"]; ok {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			json.NewEncoder(w).Encode(info)
+			return
+		}
+		if !info.IsDir {
+			http.ServeFile(w, r, path)
+			return
+		}
+		infos, err := listDir(path)
+		if err != nil {
+			http.Error(w, err.Error(), fileErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(infos)
+	}).Methods("GET")
+
+	m.HandleFunc("/files/{path:.*}", func(w http.ResponseWriter, r *http.Request) {
+		path, err := policy.CheckWrite(requestPath(r, "path"))
+		if !checkPolicy(w, err) {
+			return
+		}
+		if r.FormValue("recursive") == "true" {
+			if _, err = os.Lstat(path); err == nil {
+				err = os.RemoveAll(path)
+			}
+		} else {
+			err = os.Remove(path)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), fileErrorStatus(err))
+			return
+		}
+		io.WriteString(w, "Success")
+	}).Methods("DELETE")
+
+	// ?mkdir, ?move=<dst>, ?copy=<dst>
+	m.HandleFunc("/files/{path:.*}", func(w http.ResponseWriter, r *http.Request) {
+		path := requestPath(r, "path")
+		query := r.URL.Query()
+		var err error
+		resultPath := path
+		if _, ok := query["mkdir"]; ok {
+			var mode os.FileMode = 0755
+			if r.FormValue("mode") != "" {
+				if _, err := fmt.Sscanf(r.FormValue("mode"), "%o", &mode); err != nil {
+					http.Error(w, "invalid file mode: "+r.FormValue("mode"), http.StatusBadRequest)
+					return
+				}
+			}
+			if path, err = policy.CheckWrite(path); !checkPolicy(w, err) {
+				return
+			}
+			resultPath = path
+			err = os.MkdirAll(path, mode)
+		} else if dst := query.Get("move"); dst != "" {
+			if path, err = policy.CheckWrite(path); !checkPolicy(w, err) {
+				return
+			}
+			if dst, err = policy.CheckWrite(dst); !checkPolicy(w, err) {
+				return
+			}
+			resultPath = dst
+			err = movePath(path, dst)
+		} else if dst := query.Get("copy"); dst != "" {
+			if path, err = policy.CheckRead(path); !checkPolicy(w, err) {
+				return
+			}
+			if dst, err = policy.CheckWrite(dst); !checkPolicy(w, err) {
+				return
+			}
+			resultPath = dst
+			err = copyPath(path, dst)
+		} else {
+			http.Error(w, "one of mkdir, move or copy is required", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), fileErrorStatus(err))
+			return
+		}
+		info, err := statFile(resultPath)
+		if err != nil {
+			http.Error(w, err.Error(), fileErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(info)
+	}).Methods("POST")
+
+	m.HandleFunc("/archive/{path:.*}", func(w http.ResponseWriter, r *http.Request) {
+		dir, err := policy.CheckRead(requestPath(r, "path"))
+		if !checkPolicy(w, err) {
+			return
+		}
+		format := r.FormValue("format")
+		ar, err := archiverOf(format)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if format == "" {
+			format = "tar.gz"
+		}
+		info, err := statFile(dir)
+		if err != nil {
+			http.Error(w, err.Error(), fileErrorStatus(err))
+			return
+		}
+		if !info.IsDir {
+			http.Error(w, "not a directory: "+dir, http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(dir)+"."+format))
+		if err := writeArchive(w, ar, dir); err != nil {
+			log.Printf("archive %s error: %v", dir, err) // header already sent
+		}
+	}).Methods("GET")
+
+	m.HandleFunc("/archive/{path:.*}", func(w http.ResponseWriter, r *http.Request) {
+		target, err := policy.CheckWrite(requestPath(r, "path"))
+		if !checkPolicy(w, err) {
+			return
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer func() {
+			file.Close()
+			r.MultipartForm.RemoveAll()
+		}()
+		format := r.FormValue("format")
+		if format == "" && strings.HasSuffix(header.Filename, ".zip") {
+			format = "zip"
+		}
+		if _, err := archiverOf(format); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := extractArchive(file, format, target, r.FormValue("overwrite") == "true"); err != nil {
+			http.Error(w, err.Error(), fileErrorStatus(err))
+			return
+		}
+		infos, err := listDir(target)
+		if err != nil {
+			http.Error(w, err.Error(), fileErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(infos)
+	}).Methods("POST")
+
+	m.HandleFunc("/sync/{path:.*}", func(w http.ResponseWriter, r *http.Request) {
+		root, err := policy.CheckWrite(requestPath(r, "path"))
+		if !checkPolicy(w, err) {
+			return
+		}
+		var manifest syncManifest
+		if err := json.NewDecoder(r.Body).Decode(&manifest); err != nil {
+			http.Error(w, "invalid manifest: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := diffSync(root, manifest)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(result)
+	}).Methods("POST")
+
 	m.HandleFunc("/info/battery", func(w http.ResponseWriter, r *http.Request) {
 		devInfo := getDeviceInfo()
 		devInfo.Battery.Update()
@@ -656,6 +1005,9 @@ func ServeHTTP(lis net.Listener, tunnel *TunnelProxy) error {
 		if strings.HasSuffix(target, "/") {
 			target = path.Join(target, header.Filename)
 		}
+		if target, err = policy.CheckWrite(target); !checkPolicy(w, err) {
+			return
+		}
 
 		targetDir := filepath.Dir(target)
 		if _, err := os.Stat(targetDir); os.IsNotExist(err) {
@@ -687,8 +1039,98 @@ func ServeHTTP(lis net.Listener, tunnel *TunnelProxy) error {
 		})
 	})
 
+	m.HandleFunc("/uploads", func(w http.ResponseWriter, r *http.Request) {
+		var fileMode os.FileMode
+		if _, err := fmt.Sscanf(r.FormValue("mode"), "%o", &fileMode); err != nil {
+			fileMode = 0644
+		} // %o base 8
+		var size int64
+		if r.FormValue("size") != "" {
+			var err error
+			if size, err = strconv.ParseInt(r.FormValue("size"), 10, 64); err != nil {
+				http.Error(w, "invalid size: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		target, err := policy.CheckWrite(r.FormValue("target"))
+		if !checkPolicy(w, err) {
+			return
+		}
+		session, err := uploadManager.Create(target, size, r.FormValue("sha256"), fileMode)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(session)
+	}).Methods("POST")
+
+	m.HandleFunc("/uploads/{id}", func(w http.ResponseWriter, r *http.Request) {
+		session := uploadManager.Get(mux.Vars(r)["id"])
+		if session == nil {
+			http.Error(w, "upload not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(session)
+	}).Methods("GET")
+
+	// PUT /uploads/{id}?offset=<n> with the raw chunk as body
+	m.HandleFunc("/uploads/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid offset: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		session, err := uploadManager.WriteChunk(id, offset, r.Body)
+		switch {
+		case os.IsNotExist(err):
+			http.Error(w, "upload not found", http.StatusNotFound)
+		case err == ErrUploadOffsetMismatch:
+			// tell client where to resume
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(uploadManager.Get(id))
+		case err == ErrUploadBusy:
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			json.NewEncoder(w).Encode(session)
+		}
+	}).Methods("PUT")
+
+	m.HandleFunc("/uploads/{id}/complete", func(w http.ResponseWriter, r *http.Request) {
+		session, err := uploadManager.Complete(mux.Vars(r)["id"], r.FormValue("sha256"))
+		switch {
+		case os.IsNotExist(err):
+			http.Error(w, "upload not found", http.StatusNotFound)
+		case err == ErrUploadBusy:
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			json.NewEncoder(w).Encode(session)
+		}
+	}).Methods("POST")
+
+	m.HandleFunc("/uploads/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := uploadManager.Abort(mux.Vars(r)["id"]); err != nil {
+			http.Error(w, err.Error(), fileErrorStatus(err))
+			return
+		}
+		io.WriteString(w, "Success")
+	}).Methods("DELETE")
+
 	m.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
-		dst := r.FormValue("filepath")
+		dst, err := policy.CheckWrite(r.FormValue("filepath"))
+		if !checkPolicy(w, err) {
+			return
+		}
 		url := r.FormValue("url")
 		var fileMode os.FileMode
 		if _, err := fmt.Sscanf(r.FormValue("mode"), "%o", &fileMode); err != nil {
@@ -699,6 +1141,11 @@ func ServeHTTP(lis net.Listener, tunnel *TunnelProxy) error {
 		io.WriteString(w, key)
 	}).Methods("POST")
 
+	m.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(background.List())
+	}).Methods("GET")
+
 	m.HandleFunc("/download/{key}", func(w http.ResponseWriter, r *http.Request) {
 		key := mux.Vars(r)["key"]
 		status := background.Get(key)
@@ -706,40 +1153,37 @@ func ServeHTTP(lis net.Listener, tunnel *TunnelProxy) error {
 		json.NewEncoder(w).Encode(status)
 	}).Methods("GET")
 
-	m.HandleFunc("/install", func(w http.ResponseWriter, r *http.Request) {
-		var url = r.FormValue("url")
-		filepath := TempFileName("/sdcard/tmp", ".apk")
-		key := background.HTTPDownload(url, filepath, 0644)
-		go func() {
-			defer os.Remove(filepath) // release sdcard space
+	m.HandleFunc("/download/{key}", func(w http.ResponseWriter, r *http.Request) {
+		writeCancelResult(w, background.Cancel(mux.Vars(r)["key"]))
+	}).Methods("DELETE")
 
-			state := background.Get(key)
-			if err := background.Wait(key); err != nil {
-				log.Println("http download error")
-				state.Error = err.Error()
-				state.Message = "http download error"
+	m.HandleFunc("/install", func(w http.ResponseWriter, r *http.Request) {
+		// upload apks with multipart field "file", multiple files are installed as split apks
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			key, files, err := background.HTTPUpload(r, "/sdcard/tmp", 0644)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-
-			state.Message = "apk parsing"
-			pkg, er := apk.OpenFile(filepath)
-			if er != nil {
-				state.Error = er.Error()
-				state.Message = "androidbinary parse apk error"
+			if err := installQueue.Submit(key, "", files...); err != nil {
+				removeFiles(files)
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
 				return
 			}
-			defer pkg.Close()
-			packageName := pkg.PackageName()
-			state.PackageName = packageName
-
-			state.Message = "installing"
-			if err := installAPKForce(filepath, packageName); err != nil {
-				state.Error = err.Error()
-				state.Message = "error install"
-			} else {
-				state.Message = "success installed"
-			}
-		}()
+			io.WriteString(w, key)
+			return
+		}
+
+		var url = r.FormValue("url")
+		if url == "" {
+			http.Error(w, "url or file is required", http.StatusBadRequest)
+			return
+		}
+		key, _ := background.genKey()
+		if err := installQueue.Submit(key, url); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		io.WriteString(w, key)
 	}).Methods("POST")
 
@@ -752,17 +1196,84 @@ func ServeHTTP(lis net.Listener, tunnel *TunnelProxy) error {
 
 	m.HandleFunc("/install/{id}", func(w http.ResponseWriter, r *http.Request) {
 		id := mux.Vars(r)["id"]
-		state := background.Get(id)
-		if state.Progress != nil {
-			if dproxy, ok := state.Progress.(*downloadProxy); ok {
-				dproxy.Cancel()
-				io.WriteString(w, "Cancelled")
-				return
-			}
+		if installQueue.Cancel(id) {
+			io.WriteString(w, "Cancelled")
+			return
+		}
+		writeCancelResult(w, background.Cancel(id))
+	}).Methods("DELETE")
+
+	m.HandleFunc("/apk/inspect", handleAPKInspect).Methods("POST")
+
+	m.HandleFunc("/packages", func(w http.ResponseWriter, r *http.Request) {
+		pkgs, err := listPackages()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pkgs)
+	}).Methods("GET")
+
+	m.HandleFunc("/packages/{pkgname}", func(w http.ResponseWriter, r *http.Request) {
+		info, err := packageDetail(mux.Vars(r)["pkgname"])
+		if err != nil {
+			http.Error(w, err.Error(), packageErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	}).Methods("GET")
+
+	// ?keepData=true to keep the data and cache directories
+	m.HandleFunc("/packages/{pkgname}", func(w http.ResponseWriter, r *http.Request) {
+		packageName := mux.Vars(r)["pkgname"]
+		if _, err := packagePath(packageName); err != nil {
+			http.Error(w, err.Error(), packageErrorStatus(err))
+			return
+		}
+		if r.FormValue("keepData") == "true" {
+			writePmResult(w, runPm("uninstall", "-k", packageName))
+		} else {
+			writePmResult(w, runPm("uninstall", packageName))
 		}
-		io.WriteString(w, "Unable to canceled")
 	}).Methods("DELETE")
 
+	m.HandleFunc("/packages/{pkgname}/clear", func(w http.ResponseWriter, r *http.Request) {
+		packageName := mux.Vars(r)["pkgname"]
+		if _, err := packagePath(packageName); err != nil {
+			http.Error(w, err.Error(), packageErrorStatus(err))
+			return
+		}
+		writePmResult(w, runPm("clear", packageName))
+	}).Methods("POST")
+
+	// form value permission can be given multiple times
+	m.HandleFunc("/packages/{pkgname}/{action:grant|revoke}", func(w http.ResponseWriter, r *http.Request) {
+		packageName, action := mux.Vars(r)["pkgname"], mux.Vars(r)["action"]
+		if _, err := packagePath(packageName); err != nil {
+			http.Error(w, err.Error(), packageErrorStatus(err))
+			return
+		}
+		r.ParseForm()
+		permissions := r.Form["permission"]
+		if len(permissions) == 0 {
+			http.Error(w, "permission is required", http.StatusBadRequest)
+			return
+		}
+		results := make(map[string]pmResult, len(permissions))
+		status := http.StatusOK
+		for _, perm := range permissions {
+			results[perm] = runPm(action, packageName, perm)
+			if !results[perm].Success {
+				status = http.StatusInternalServerError
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(results)
+	}).Methods("POST")
+
 	m.HandleFunc("/minitouch", singleFightNewerWebsocket(func(w http.ResponseWriter, r *http.Request, ws *websocket.Conn) {
 		defer ws.Close()
 		const wsWriteWait = 10 * time.Second
@@ -779,10 +1290,13 @@ func ServeHTTP(lis net.Listener, tunnel *TunnelProxy) error {
 		log.Printf("minitouch connection: %v", r.RemoteAddr)
 		retries := 0
 		quitC := make(chan bool, 2)
-		operC := make(chan TouchRequest, 10)
+		operC := make(chan []TouchRequest, 10)
+		contacts := newTouchTracker()
+		setActiveTouchTracker(contacts)
 		defer func() {
 			wsWrite(websocket.TextMessage, []byte("unix:@minitouch websocket closed"))
 			close(operC)
+			releaseTouchTracker(contacts)
 		}()
 		go func() {
 			for {
@@ -815,16 +1329,39 @@ func ServeHTTP(lis net.Listener, tunnel *TunnelProxy) error {
 				}
 			}
 		}()
-		var touchRequest TouchRequest
+		display := getDeviceInfo().Display
 		for {
-			err := ws.ReadJSON(&touchRequest)
+			_, data, err := ws.ReadMessage()
 			if err != nil {
-				log.Println("readJson err:", err)
+				log.Println("read message err:", err)
 				quitC <- true
 				break
 			}
+			// one message can be a single request or an array of requests
+			touchRequests, err := parseTouchRequests(data)
+			if err != nil {
+				wsWrite(websocket.TextMessage, []byte("invalid touch request: "+err.Error()))
+				continue
+			}
+			t := toucher{
+				width:    display.Width,
+				height:   display.Height,
+				rotation: deviceRotation,
+			}
+			for i, req := range touchRequests {
+				if touchRequests[i], err = t.Native(req); err != nil {
+					break
+				}
+			}
+			if err != nil {
+				wsWrite(websocket.TextMessage, []byte("invalid touch request: "+err.Error()))
+				continue
+			}
 			select {
-			case operC <- touchRequest:
+			case operC <- touchRequests:
+				for _, req := range touchRequests {
+					contacts.Apply(req)
+				}
 			case <-time.After(2 * time.Second):
 				wsWrite(websocket.TextMessage, []byte("touch request buffer full"))
 			}
@@ -847,6 +1384,7 @@ func ServeHTTP(lis net.Listener, tunnel *TunnelProxy) error {
 
 		wsWrite(websocket.TextMessage, []byte("dial unix:@minicap"))
 		log.Printf("minicap connection: %v", r.RemoteAddr)
+		showTouches := r.FormValue("touches") == "true" // annotate frames with active minitouch contacts
 		dataC := make(chan []byte, 10)
 		quitC := make(chan bool, 2)
 
@@ -892,6 +1430,15 @@ func ServeHTTP(lis net.Listener, tunnel *TunnelProxy) error {
 		}()
 		for data := range dataC {
 			if string(data[:2]) == "\xff\xd8" { // jpeg data
+				if showTouches {
+					if points := activeTouchContacts(); len(points) > 0 {
+						if annotated, err := annotateJPEG(data, points, deviceRotation); err == nil {
+							data = annotated
+						} else {
+							log.Println("annotate touches err:", err)
+						}
+					}
+				}
 				if err := wsWrite(websocket.BinaryMessage, data); err != nil {
 					break
 				}
@@ -915,6 +1462,7 @@ func ServeHTTP(lis net.Listener, tunnel *TunnelProxy) error {
 	var recordLock sync.Mutex
 	var recordFolder = "/sdcard/screenrecords/"
 	var recordRunning = false
+	var recordShowTouches = "" // previous value of show_touches, empty if not changed
 
 	m.HandleFunc("/screenrecord", func(w http.ResponseWriter, r *http.Request) {
 		recordLock.Lock()
@@ -926,8 +1474,22 @@ func ServeHTTP(lis net.Listener, tunnel *TunnelProxy) error {
 		}
 		os.RemoveAll(recordFolder)
 		os.MkdirAll(recordFolder, 0755)
+		// screenrecord can not be annotated by agent, use the system touch markers instead
+		if r.FormValue("touches") == "true" {
+			output, _ := runShellOutput("settings", "get", "system", "show_touches")
+			recordShowTouches = "0" // also when not set
+			if strings.TrimSpace(string(output)) == "1" {
+				recordShowTouches = "1"
+			}
+			runShell("settings", "put", "system", "show_touches", "1")
+		}
 		recordCmd = exec.Command("screenrecord", recordFolder+"0.mp4")
 		if err := recordCmd.Start(); err != nil {
+			recordCmd = nil
+			if recordShowTouches != "" {
+				runShell("settings", "put", "system", "show_touches", recordShowTouches)
+				recordShowTouches = ""
+			}
 			http.Error(w, err.Error(), 500)
 			return
 		}
@@ -962,6 +1524,10 @@ func ServeHTTP(lis net.Listener, tunnel *TunnelProxy) error {
 			}
 			recordCmd = nil
 		}
+		if recordShowTouches != "" {
+			runShell("settings", "put", "system", "show_touches", recordShowTouches)
+			recordShowTouches = ""
+		}
 		w.Header().Set("Content-Type", "application/json")
 		files, _ := ioutil.ReadDir(recordFolder)
 		videos := []string{}
@@ -999,7 +1565,15 @@ func ServeHTTP(lis net.Listener, tunnel *TunnelProxy) error {
 		}()
 	})
 
+	m.HandleFunc("/term/sessions", handleTermSessions).Methods("GET")
+	m.HandleFunc("/term/sessions/{id}", handleTermSessionClose).Methods("DELETE")
+	m.HandleFunc("/term/records", handleTermRecords).Methods("GET")
+	m.HandleFunc("/term/records/{name}", handleTermRecordDownload).Methods("GET")
+
 	m.HandleFunc("/term", func(w http.ResponseWriter, r *http.Request) {
+		if !checkPolicy(w, policy.CheckShell()) {
+			return
+		}
 		if r.Header.Get("Upgrade") == "websocket" {
 			handleTerminalWebsocket(w, r)
 			return
@@ -1007,10 +1581,15 @@ func ServeHTTP(lis net.Listener, tunnel *TunnelProxy) error {
 		renderHTML(w, "terminal.html")
 	})
 
+	m.HandleFunc("/audit", handleAuditQuery).Methods("GET")
+
 	m.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
 		info := getDeviceInfo()
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(info)
+		json.NewEncoder(w).Encode(struct {
+			*proto.DeviceInfo
+			TLSFingerprint string `json:"tlsFingerprint,omitempty"`
+		}{info, tlsFingerprint})
 	})
 
 	screenshotFilename := "/data/local/tmp/minicap-screenshot.jpg"
@@ -1040,11 +1619,38 @@ func ServeHTTP(lis net.Listener, tunnel *TunnelProxy) error {
 
 	m.Handle("/assets/{(.*)}", http.StripPrefix("/assets", http.FileServer(Assets)))
 
-	var handler = cors.New(cors.Options{}).Handler(m)
+	var handler = cors.New(cors.Options{
+		AllowedOrigins: auth.origins, // empty means all
+		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "HEAD"},
+		AllowedHeaders: []string{"Authorization", "Content-Type"},
+	}).Handler(auditLog.Middleware(auth.Middleware(m)))
+	if tlsConfig != nil && tlsConfig.ClientCAs != nil {
+		handler = requireClientCert(handler)
+	}
 	httpServer = &http.Server{Handler: handler} // url(/stop) need it.
 	return httpServer.Serve(lis)
 }
 
+// httpGetLocal request the local server with admin token
+func httpGetLocal(path string) (*http.Response, error) {
+	scheme, client := "http", http.DefaultClient
+	if tlsConfig != nil {
+		// certificate is not verified, the server is on the same device
+		scheme = "https"
+		client = &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}}
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s://127.0.0.1:%d%s", scheme, listenPort, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := auth.AdminToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return client.Do(req)
+}
+
 func runDaemon() {
 	environ := os.Environ()
 	// env:IGNORE_SIGHUP forward stdout and stderr to file
@@ -1069,15 +1675,55 @@ func main() {
 	fStop := flag.Bool("stop", false, "stop server")
 	fTunnelServer := flag.String("t", "", "tunnel server address")
 	fNoUiautomator := flag.Bool("nouia", false, "not start uiautomator")
+	fPolicy := flag.String("policy", "", "policy json file, limit file paths and shell access")
+	fToken := flag.String("token", "", "admin token, enable token authentication")
+	fTokens := flag.String("tokens", "", "tokens json file, enable token authentication")
+	fOrigins := flag.String("origins", "", "allowed CORS and websocket origins, separated by comma")
+	fAudit := flag.String("audit", defaultAuditLogFile, "audit log file of mutating requests, empty to disable")
+	fTLS := flag.Bool("tls", false, "serve https with self-signed certificate if -tls-cert not set")
+	fTLSCert := flag.String("tls-cert", "", "tls certificate file")
+	fTLSKey := flag.String("tls-key", "", "tls private key file")
+	fTLSClientCA := flag.String("tls-client-ca", "", "ca file to verify client certificates")
 	flag.Parse()
 
+	var tokens []authToken
+	if *fTokens != "" {
+		var err error
+		if tokens, err = loadAuthTokens(*fTokens); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *fToken != "" {
+		tokens = append(tokens, authToken{Token: *fToken, Name: "admin", Role: "admin"})
+	}
+	var origins []string
+	if *fOrigins != "" {
+		origins = strings.Split(*fOrigins, ",")
+	}
+	if a, err := newAuth(tokens, origins); err != nil {
+		log.Fatal(err)
+	} else {
+		auth = a
+	}
+
+	auditLog = newAuditLog(*fAudit)
+
+	if *fTLS || *fTLSCert != "" || *fTLSClientCA != "" {
+		config, err := loadTLSConfig(*fTLSCert, *fTLSKey, *fTLSClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsConfig = config
+		tlsFingerprint = certFingerprint(config.Certificates[0].Certificate[0])
+	}
+
 	if *fVersion {
 		fmt.Println(version)
 		return
 	}
 
 	if *fStop {
-		_, err := http.Get("http://127.0.0.1:7912/stop")
+		_, err := httpGetLocal("/stop")
 		if err != nil {
 			log.Println(err)
 		} else {
@@ -1120,7 +1766,7 @@ func main() {
 
 		// kill previous daemon first
 		log.Println("Kill server")
-		_, err = http.Get(fmt.Sprintf("http://127.0.0.1:%d/stop", listenPort))
+		_, err = httpGetLocal("/stop")
 		if err == nil {
 			log.Println("wait previous server stopped")
 			time.Sleep(1000 * time.Millisecond) // server will quit in 0.1s
@@ -1131,10 +1777,27 @@ func main() {
 
 	fmt.Printf("atx-agent version %s\n", version)
 
+	if *fPolicy != "" {
+		p, err := loadPolicy(*fPolicy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		policy = p
+		log.Printf("policy loaded: %+v", *policy)
+	}
+	// cmdline of the agent contains -token
+	policy.Protect(*fTokens, *fPolicy, *fTLSKey, selfSignedKeyFile, termRecordFolder, "/proc/self")
+	policy.Protect(auditLog.Files()...)
+
 	// show ip
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+		fmt.Printf("TLS certificate fingerprint(sha256): %s\n", tlsFingerprint)
+	}
 	outIp, err := getOutboundIP()
 	if err == nil {
-		fmt.Printf("Listen on http://%v:%d\n", outIp, listenPort)
+		fmt.Printf("Listen on %s://%v:%d\n", scheme, outIp, listenPort)
 	} else {
 		fmt.Printf("Internet is not connected.")
 	}
@@ -1143,6 +1806,9 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
 
 	// minicap + minitouch
 	devInfo := getDeviceInfo()
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -21,12 +23,72 @@ type TouchRequest struct {
 	Index        int     `json:"index"`
 	PercentX     float64 `json:"xP"`
 	PercentY     float64 `json:"yP"`
+	X            float64 `json:"x"`
+	Y            float64 `json:"y"`
+	Coord        string  `json:"coord"` // "": native percent(xP, yP), display: display percent(xP, yP), pixel: display pixel(x, y)
 	Milliseconds int     `json:"milliseconds"`
 	Pressure     float64 `json:"pressure"`
 }
 
+// Native convert coords of d and m request to percent of minitouch native orientation
+// width and height is the display size without rotation
+func (t toucher) Native(req TouchRequest) (TouchRequest, error) {
+	if req.Operation != "d" && req.Operation != "m" {
+		return req, nil
+	}
+	switch req.Coord {
+	case "":
+		return req, nil
+	case "pixel":
+		width, height := t.width, t.height
+		if t.rotation == 90 || t.rotation == 270 {
+			width, height = height, width
+		}
+		if width <= 0 || height <= 0 {
+			return req, errors.New("display size unknown")
+		}
+		req.PercentX = req.X / float64(width)
+		req.PercentY = req.Y / float64(height)
+	case "display":
+	default:
+		return req, errors.New("unsupported coord: " + req.Coord)
+	}
+	req.PercentX, req.PercentY = displayToNative(req.PercentX, req.PercentY, t.rotation)
+	req.Coord = ""
+	return req, nil
+}
+
+// nativeToDisplay convert percent coord from minitouch native orientation to the rotated display
+func nativeToDisplay(xP, yP float64, rotation int) (float64, float64) {
+	switch rotation {
+	case 90:
+		return yP, 1 - xP
+	case 180:
+		return 1 - xP, 1 - yP
+	case 270:
+		return 1 - yP, xP
+	default:
+		return xP, yP
+	}
+}
+
+// displayToNative is the reverse of nativeToDisplay
+func displayToNative(xP, yP float64, rotation int) (float64, float64) {
+	switch rotation {
+	case 90:
+		return 1 - yP, xP
+	case 180:
+		return 1 - xP, 1 - yP
+	case 270:
+		return yP, 1 - xP
+	default:
+		return xP, yP
+	}
+}
+
 // coord(0, 0) is always left-top conner, no matter the rotation changes
-func drainTouchRequests(conn net.Conn, reqC chan TouchRequest) error {
+// each value from reqC is a batch of requests, which is written to @minitouch atomically
+func drainTouchRequests(conn net.Conn, reqC chan []TouchRequest) error {
 	var maxX, maxY int
 	var flag string
 	var ver int
@@ -47,40 +109,67 @@ func drainTouchRequests(conn net.Conn, reqC chan TouchRequest) error {
 	}).Info("handle touch requests")
 	go io.Copy(ioutil.Discard, conn) // ignore the rest output
 	var posX, posY int
-	for req := range reqC {
-		var err error
-		switch req.Operation {
-		case "d":
-			fallthrough
-		case "m":
-			posX = int(req.PercentX * float64(maxX))
-			posY = int(req.PercentY * float64(maxY))
-			pressure := int(req.Pressure * float64(maxPressure))
-			if pressure == 0 {
-				pressure = maxPressure - 1
+	for reqs := range reqC {
+		// write the whole batch at once, so operations will not be interleaved
+		buf := bytes.NewBuffer(nil)
+		for _, req := range reqs {
+			switch req.Operation {
+			case "d":
+				fallthrough
+			case "m":
+				posX = int(req.PercentX * float64(maxX))
+				posY = int(req.PercentY * float64(maxY))
+				pressure := int(req.Pressure * float64(maxPressure))
+				if pressure == 0 {
+					pressure = maxPressure - 1
+				}
+				fmt.Fprintf(buf, "%s %d %d %d %d\n", req.Operation, req.Index, posX, posY, pressure)
+			case "u":
+				fmt.Fprintf(buf, "u %d\n", req.Index)
+			case "c":
+				buf.WriteString("c\n")
+			case "w":
+				fmt.Fprintf(buf, "w %d\n", req.Milliseconds)
+			default:
+				return errors.New("unsupported operation: " + req.Operation)
 			}
-			line := fmt.Sprintf("%s %d %d %d %d\n", req.Operation, req.Index, posX, posY, pressure)
-			log.WithFields(log.Fields{
-				"touch":      req,
-				"remoteAddr": conn.RemoteAddr(),
-			}).Debug("write to @minitouch", line)
-			_, err = conn.Write([]byte(line))
-		case "u":
-			_, err = conn.Write([]byte(fmt.Sprintf("u %d\n", req.Index)))
-		case "c":
-			_, err = conn.Write([]byte("c\n"))
-		case "w":
-			_, err = conn.Write([]byte(fmt.Sprintf("w %d\n", req.Milliseconds)))
-		default:
-			err = errors.New("unsupported operation: " + req.Operation)
 		}
-		if err != nil {
+		log.WithFields(log.Fields{
+			"touches":    len(reqs),
+			"remoteAddr": conn.RemoteAddr(),
+		}).Debug("write to @minitouch", buf.String())
+		if _, err := conn.Write(buf.Bytes()); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// parseTouchRequests accept a single TouchRequest or an array of them
+// The whole batch is rejected if any operation is unsupported
+func parseTouchRequests(data []byte) (reqs []TouchRequest, err error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		if err = json.Unmarshal(data, &reqs); err != nil {
+			return nil, err
+		}
+	} else {
+		var req TouchRequest
+		if err = json.Unmarshal(data, &req); err != nil {
+			return nil, err
+		}
+		reqs = []TouchRequest{req}
+	}
+	for _, req := range reqs {
+		switch req.Operation {
+		case "d", "m", "u", "c", "w":
+		default:
+			return nil, errors.New("unsupported operation: " + req.Operation)
+		}
+	}
+	return reqs, nil
+}
+
 type lineFormatReader struct {
 	bufrd *bufio.Reader
 	err   error
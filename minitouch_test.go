@@ -29,7 +29,7 @@ func (c *MockConn) SetReadDeadline(t time.Time) error  { return nil }
 func (c *MockConn) SetWriteDeadline(t time.Time) error { return nil }
 
 func TestDrainTouchRequests(t *testing.T) {
-	reqC := make(chan TouchRequest, 0)
+	reqC := make(chan []TouchRequest, 0)
 	conn := &MockConn{
 		buffer: bytes.NewBuffer(nil),
 	}
@@ -41,30 +41,113 @@ func TestDrainTouchRequests(t *testing.T) {
 ^ 10 1080 1920 255
 $ 25654`),
 	}
-	reqC = make(chan TouchRequest, 4)
-	reqC <- TouchRequest{
+	reqC = make(chan []TouchRequest, 4)
+	reqC <- []TouchRequest{{
 		Operation: "d",
 		Index:     1,
 		PercentX:  1.0,
 		PercentY:  1.0,
 		Pressure:  1,
-	}
-	reqC <- TouchRequest{
+	}}
+	reqC <- []TouchRequest{{
 		Operation: "c",
-	}
-	reqC <- TouchRequest{
+	}}
+	reqC <- []TouchRequest{{
 		Operation: "m",
 		Index:     3,
 		PercentX:  0.5,
 		PercentY:  0.5,
 		Pressure:  1,
-	}
-	reqC <- TouchRequest{
+	}}
+	reqC <- []TouchRequest{{
 		Operation: "u",
 		Index:     4,
-	}
+	}}
 	close(reqC)
 	drainTouchRequests(conn, reqC)
 	output := string(conn.buffer.Bytes())
 	assert.Equal(t, "d 1 1080 1920 255\nc\nm 3 540 960 255\nu 4\n", output)
 }
+
+func TestDrainTouchRequestsBatch(t *testing.T) {
+	conn := &MockConn{
+		buffer: bytes.NewBufferString(`v 1
+^ 10 1080 1920 255
+$ 25654`),
+	}
+	reqs, err := parseTouchRequests([]byte(`[
+		{"operation": "d", "index": 0, "xP": 0.5, "yP": 0.5, "pressure": 1},
+		{"operation": "c"},
+		{"operation": "w", "milliseconds": 50},
+		{"operation": "m", "index": 0, "xP": 0.5, "yP": 1.0, "pressure": 1},
+		{"operation": "c"},
+		{"operation": "u", "index": 0},
+		{"operation": "c"}
+	]`))
+	assert.NoError(t, err)
+	reqC := make(chan []TouchRequest, 1)
+	reqC <- reqs
+	close(reqC)
+	assert.NoError(t, drainTouchRequests(conn, reqC))
+	assert.Equal(t, "d 0 540 960 255\nc\nw 50\nm 0 540 1920 255\nc\nu 0\nc\n", conn.buffer.String())
+
+	reqs, err = parseTouchRequests([]byte(`{"operation": "c"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []TouchRequest{{Operation: "c"}}, reqs)
+
+	// unsupported operation is rejected before sent to @minitouch
+	_, err = parseTouchRequests([]byte(`[{"operation": "c"}, {"operation": "x"}]`))
+	assert.Error(t, err)
+	_, err = parseTouchRequests([]byte(`{"operation": "r"}`))
+	assert.Error(t, err)
+
+	// unsupported operation drops the whole batch
+	conn = &MockConn{
+		buffer: bytes.NewBufferString(`v 1
+^ 10 1080 1920 255
+$ 25654`),
+	}
+	reqC = make(chan []TouchRequest, 1)
+	reqC <- []TouchRequest{{Operation: "c"}, {Operation: "x"}}
+	close(reqC)
+	assert.Error(t, drainTouchRequests(conn, reqC))
+	assert.Equal(t, "", conn.buffer.String())
+}
+
+func TestToucherNative(t *testing.T) {
+	// display size without rotation is 1080x1920
+	for _, tc := range []struct {
+		rotation int
+		req      TouchRequest
+		xP, yP   float64
+		name     string
+	}{
+		{0, TouchRequest{Operation: "d", Coord: "display", PercentX: 0.25, PercentY: 0.75}, 0.25, 0.75, "display 0"},
+		{90, TouchRequest{Operation: "d", Coord: "display", PercentX: 0.25, PercentY: 0.75}, 0.25, 0.25, "display 90"},
+		{180, TouchRequest{Operation: "d", Coord: "display", PercentX: 0.25, PercentY: 0.75}, 0.75, 0.25, "display 180"},
+		{270, TouchRequest{Operation: "d", Coord: "display", PercentX: 0.25, PercentY: 0.75}, 0.75, 0.75, "display 270"},
+		{0, TouchRequest{Operation: "m", Coord: "pixel", X: 270, Y: 480}, 0.25, 0.25, "pixel 0"},
+		{90, TouchRequest{Operation: "m", Coord: "pixel", X: 480, Y: 810}, 0.25, 0.25, "pixel 90"},
+		{180, TouchRequest{Operation: "m", Coord: "pixel", X: 270, Y: 480}, 0.75, 0.75, "pixel 180"},
+		{270, TouchRequest{Operation: "m", Coord: "pixel", X: 480, Y: 810}, 0.75, 0.75, "pixel 270"},
+		{90, TouchRequest{Operation: "d", PercentX: 0.1, PercentY: 0.2}, 0.1, 0.2, "native"},
+	} {
+		req, err := toucher{width: 1080, height: 1920, rotation: tc.rotation}.Native(tc.req)
+		assert.NoError(t, err, tc.name)
+		assert.InDelta(t, tc.xP, req.PercentX, 1e-9, tc.name)
+		assert.InDelta(t, tc.yP, req.PercentY, 1e-9, tc.name)
+		assert.Equal(t, "", req.Coord, tc.name)
+
+		// back to where it comes from
+		if tc.req.Coord == "display" {
+			xP, yP := nativeToDisplay(req.PercentX, req.PercentY, tc.rotation)
+			assert.InDelta(t, tc.req.PercentX, xP, 1e-9, tc.name)
+			assert.InDelta(t, tc.req.PercentY, yP, 1e-9, tc.name)
+		}
+	}
+
+	_, err := toucher{width: 1080, height: 1920}.Native(TouchRequest{Operation: "d", Coord: "unknown"})
+	assert.Error(t, err)
+	_, err = toucher{}.Native(TouchRequest{Operation: "d", Coord: "pixel"})
+	assert.Error(t, err)
+}
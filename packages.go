@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shogo82148/androidbinary/apk"
+)
+
+var (
+	dumpsysPackageRe = regexp.MustCompile(`^\s*Package \[([\w.]+)\]`)
+	pmListPackageRe  = regexp.MustCompile(`package:(.+)=([.\w]+)`)
+	// package and permission names are passed to shell without quote
+	validPackageNameRe = regexp.MustCompile(`^[\w.]+$`)
+	validPmArgRe       = regexp.MustCompile(`^-?[\w.]+$`)
+)
+
+type packagePermission struct {
+	Name    string `json:"name"`
+	Granted bool   `json:"granted"`
+}
+
+type packageInfo struct {
+	PackageName      string              `json:"packageName"`
+	VersionCode      int                 `json:"versionCode"`
+	VersionName      string              `json:"versionName"`
+	FirstInstallTime time.Time           `json:"firstInstallTime"`
+	LastUpdateTime   time.Time           `json:"lastUpdateTime"`
+	System           bool                `json:"system"`
+	Path             string              `json:"path"`
+	MainActivity     string              `json:"mainActivity,omitempty"`
+	Permissions      []packagePermission `json:"permissions,omitempty"` // requested permissions
+
+	granted map[string]bool
+}
+
+// parseDumpsysPackages parse output of "dumpsys package packages" or "dumpsys package <name>"
+func parseDumpsysPackages(output string) map[string]*packageInfo {
+	pkgs := make(map[string]*packageInfo)
+	var cur *packageInfo
+	for _, line := range strings.Split(output, "\n") {
+		if matches := dumpsysPackageRe.FindStringSubmatch(line); matches != nil {
+			if _, ok := pkgs[matches[1]]; ok {
+				cur = nil // Hidden system packages, the updated one is already parsed
+				continue
+			}
+			cur = &packageInfo{PackageName: matches[1], granted: make(map[string]bool)}
+			pkgs[matches[1]] = cur
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "versionCode="):
+			fmt.Sscanf(line, "versionCode=%d", &cur.VersionCode)
+		case strings.HasPrefix(line, "versionName="):
+			cur.VersionName = strings.TrimPrefix(line, "versionName=")
+		case strings.HasPrefix(line, "firstInstallTime="):
+			cur.FirstInstallTime, _ = time.ParseInLocation("2006-01-02 15:04:05", strings.TrimPrefix(line, "firstInstallTime="), time.Local)
+		case strings.HasPrefix(line, "lastUpdateTime="):
+			cur.LastUpdateTime, _ = time.ParseInLocation("2006-01-02 15:04:05", strings.TrimPrefix(line, "lastUpdateTime="), time.Local)
+		case strings.HasPrefix(line, "pkgFlags="):
+			cur.System = strings.Contains(line, " SYSTEM ")
+		case strings.Contains(line, ": granted="):
+			// android.permission.CAMERA: granted=true, flags=[ USER_SET ]
+			parts := strings.SplitN(line, ": granted=", 2)
+			cur.granted[parts[0]] = strings.HasPrefix(parts[1], "true")
+		}
+	}
+	return pkgs
+}
+
+// listPackages return all installed packages sorted by name
+func listPackages() ([]*packageInfo, error) {
+	output, err := runShellOutput("dumpsys", "package", "packages")
+	if err != nil {
+		return nil, err
+	}
+	pkgs := parseDumpsysPackages(string(output))
+	output, err = runShellOutput("pm", "list", "packages", "-f")
+	if err != nil {
+		return nil, err
+	}
+	for _, matches := range pmListPackageRe.FindAllStringSubmatch(string(output), -1) {
+		if pkg, ok := pkgs[matches[2]]; ok {
+			pkg.Path = matches[1]
+		}
+	}
+	result := make([]*packageInfo, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		result = append(result, pkg)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].PackageName < result[j].PackageName
+	})
+	return result, nil
+}
+
+var errPackageNotFound = errors.New("package not found")
+
+func packageErrorStatus(err error) int {
+	if err == errPackageNotFound {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+// packagePath return path of the base apk
+func packagePath(packageName string) (string, error) {
+	if !validPackageNameRe.MatchString(packageName) {
+		return "", errors.New("invalid package name: " + packageName)
+	}
+	output, _ := runShellOutput("pm", "path", packageName)
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "package:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "package:")), nil
+		}
+	}
+	return "", errPackageNotFound
+}
+
+// packageDetail return package info with main activity and requested permissions
+func packageDetail(packageName string) (*packageInfo, error) {
+	path, err := packagePath(packageName)
+	if err != nil {
+		return nil, err
+	}
+	output, err := runShellOutput("dumpsys", "package", packageName)
+	if err != nil {
+		return nil, err
+	}
+	info, ok := parseDumpsysPackages(string(output))[packageName]
+	if !ok {
+		return nil, errPackageNotFound
+	}
+	info.Path = path
+	info.Permissions = []packagePermission{}
+	pkg, err := apk.OpenFile(path)
+	if err != nil {
+		log.Printf("parse apk %s error: %v", path, err)
+		return info, nil
+	}
+	defer pkg.Close()
+	info.MainActivity, _ = pkg.MainAcitivty()
+	for _, perm := range pkg.Manifest().UsesPermissions {
+		info.Permissions = append(info.Permissions, packagePermission{
+			Name:    perm.Name,
+			Granted: info.granted[perm.Name],
+		})
+	}
+	return info, nil
+}
+
+type pmResult struct {
+	Success bool   `json:"success"`
+	Code    string `json:"code,omitempty"` // eg: DELETE_FAILED_INTERNAL_ERROR
+	Error   string `json:"error,omitempty"`
+	Output  string `json:"output"`
+}
+
+// parsePmResult check pm output, pm may exit with 0 even if failed on old android
+func parsePmResult(out []byte, err error) pmResult {
+	output := strings.TrimSpace(string(out))
+	result := pmResult{Success: true, Output: output}
+	if matches := pmFailureRe.FindStringSubmatch(output); matches != nil {
+		result.Success = false
+		result.Code = matches[1]
+		result.Error = matches[0]
+		return result
+	}
+	for _, line := range strings.Split(output, "\n") {
+		if line == "Failed" || strings.HasPrefix(line, "Error:") || strings.Contains(line, "Exception:") {
+			result.Success = false
+			result.Error = line
+			return result
+		}
+	}
+	if err != nil {
+		result.Success = false
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func runPm(args ...string) pmResult {
+	for _, arg := range args {
+		if !validPmArgRe.MatchString(arg) {
+			return pmResult{Error: "invalid argument: " + arg}
+		}
+	}
+	return parsePmResult(runShell(append([]string{"pm"}, args...)...))
+}
+
+func writePmResult(w http.ResponseWriter, result pmResult) {
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Success {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(result)
+}
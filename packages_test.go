@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const dumpsysPackagesOutput = `Packages:
+  Package [com.android.chrome] (8e1c2f4):
+    userId=10035
+    pkg=Package{a3b5c1d com.android.chrome}
+    codePath=/data/app/com.android.chrome-1
+    versionCode=332711112 minSdk=24 targetSdk=26
+    versionName=64.0.3282.137
+    pkgFlags=[ SYSTEM HAS_CODE ALLOW_CLEAR_USER_DATA UPDATED_SYSTEM_APP ]
+    timeStamp=2018-03-01 10:00:00
+    firstInstallTime=2008-12-31 16:00:00
+    lastUpdateTime=2018-03-01 10:00:01
+    install permissions:
+      android.permission.INTERNET: granted=true
+    User 0: ceDataInode=1234 installed=true hidden=false suspended=false stopped=false
+      runtime permissions:
+        android.permission.CAMERA: granted=false, flags=[ USER_SET ]
+  Package [com.github.uiautomator] (12ab34c):
+    versionCode=10 minSdk=18 targetSdk=25
+    versionName=1.0.10
+    pkgFlags=[ HAS_CODE ALLOW_CLEAR_USER_DATA ALLOW_BACKUP ]
+    firstInstallTime=2018-03-02 11:00:00
+
+Hidden system packages:
+  Package [com.android.chrome] (5d6e7f8):
+    versionCode=300000000 minSdk=24 targetSdk=26
+    versionName=60.0
+`
+
+func TestParseDumpsysPackages(t *testing.T) {
+	pkgs := parseDumpsysPackages(dumpsysPackagesOutput)
+	assert.Len(t, pkgs, 2)
+	chrome := pkgs["com.android.chrome"]
+	assert.Equal(t, 332711112, chrome.VersionCode)
+	assert.Equal(t, "64.0.3282.137", chrome.VersionName)
+	assert.True(t, chrome.System)
+	assert.Equal(t, 2018, chrome.LastUpdateTime.Year())
+	assert.True(t, chrome.granted["android.permission.INTERNET"])
+	assert.False(t, chrome.granted["android.permission.CAMERA"])
+
+	uia := pkgs["com.github.uiautomator"]
+	assert.False(t, uia.System)
+	assert.Equal(t, 11, uia.FirstInstallTime.Hour())
+}
+
+func TestParsePmResult(t *testing.T) {
+	result := parsePmResult([]byte("Success\n"), nil)
+	assert.True(t, result.Success)
+
+	result = parsePmResult([]byte("Failure [DELETE_FAILED_INTERNAL_ERROR]\n"), nil)
+	assert.False(t, result.Success)
+	assert.Equal(t, "DELETE_FAILED_INTERNAL_ERROR", result.Code)
+
+	result = parsePmResult([]byte("Failed\n"), nil)
+	assert.False(t, result.Success)
+
+	result = parsePmResult([]byte("Exception occurred while executing:\njava.lang.SecurityException: Package com.example has not requested permission android.permission.CAMERA"), errors.New("exit status 255"))
+	assert.False(t, result.Success)
+	assert.Contains(t, result.Error, "SecurityException")
+
+	assert.False(t, runPm("grant", "com.example", "android.permission.CAMERA;reboot").Success)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Policy limit which paths can be accessed by file endpoints and whether shell is allowed
+// Empty roots means no limitation, so the default policy allows everything
+type Policy struct {
+	ReadRoots    []string `json:"readRoots"` // write roots are also readable
+	WriteRoots   []string `json:"writeRoots"`
+	DenyPaths    []string `json:"denyPaths"`
+	DisableShell bool     `json:"disableShell"`
+
+	protectedPaths []string // files of the agent itself, eg: tokens and private key
+}
+
+var policy = &Policy{}
+
+// loadPolicy read policy from json file, roots are resolved in advance
+func loadPolicy(filename string) (*Policy, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p := &Policy{}
+	if err := json.NewDecoder(f).Decode(p); err != nil {
+		return nil, fmt.Errorf("parse policy %s: %v", filename, err)
+	}
+	for _, paths := range [][]string{p.ReadRoots, p.WriteRoots, p.DenyPaths} {
+		for i, path := range paths {
+			if paths[i], err = resolvePath(path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return p, nil
+}
+
+// Protect deny paths in file endpoints even if the policy allows everything
+// It's used for secrets of the agent, which should not be read by a viewer token
+func (p *Policy) Protect(paths ...string) {
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		realPath, err := resolvePath(path)
+		if err != nil {
+			log.Printf("protect %s: %v", path, err)
+			continue
+		}
+		p.protectedPaths = append(p.protectedPaths, realPath)
+	}
+}
+
+type policyError struct {
+	reason string
+}
+
+func (e *policyError) Error() string {
+	return "policy denied: " + e.reason
+}
+
+// CheckRead return the path which handlers should act on, see check
+func (p *Policy) CheckRead(path string) (string, error) {
+	if len(p.ReadRoots) == 0 {
+		return p.check("read", path, nil)
+	}
+	roots := make([]string, 0, len(p.ReadRoots)+len(p.WriteRoots))
+	roots = append(roots, p.ReadRoots...)
+	return p.check("read", path, append(roots, p.WriteRoots...))
+}
+
+func (p *Policy) CheckWrite(path string) (string, error) {
+	return p.check("write", path, p.WriteRoots)
+}
+
+func (p *Policy) CheckShell() error {
+	if p.DisableShell {
+		return &policyError{"shell is disabled"}
+	}
+	return nil
+}
+
+// check return the absolute path with parent directories resolved, handlers should act on it instead of the origin path
+// The last element is kept so a symlink itself can be removed or moved, but the target of it is also checked
+func (p *Policy) check(op string, path string, roots []string) (string, error) {
+	if len(roots) == 0 && len(p.DenyPaths) == 0 && len(p.protectedPaths) == 0 {
+		return path, nil
+	}
+	checkPath, err := resolveParent(path)
+	if err != nil {
+		return "", &policyError{fmt.Sprintf("%s %s: %v", op, path, err)}
+	}
+	realPath, err := resolvePath(checkPath)
+	if err != nil {
+		return "", &policyError{fmt.Sprintf("%s %s: %v", op, path, err)}
+	}
+	for _, target := range []string{checkPath, realPath} {
+		if err := p.checkWithin(op, path, target, roots); err != nil {
+			return "", err
+		}
+	}
+	return checkPath, nil
+}
+
+func (p *Policy) checkWithin(op string, path string, realPath string, roots []string) error {
+	for _, deny := range p.DenyPaths {
+		if pathWithin(realPath, deny) {
+			return &policyError{fmt.Sprintf("%s %s is under denied path %s", op, path, deny)}
+		}
+	}
+	for _, protected := range p.protectedPaths {
+		if pathWithin(realPath, protected) {
+			return &policyError{fmt.Sprintf("%s %s is protected", op, path)}
+		}
+	}
+	if len(roots) == 0 {
+		return nil
+	}
+	for _, root := range roots {
+		if pathWithin(realPath, root) {
+			return nil
+		}
+	}
+	return &policyError{fmt.Sprintf("%s %s is outside of allowed roots %v", op, path, roots)}
+}
+
+// checkDotDot reject .. in path, because filepath.Abs clean it before symlinks are evaluated
+// eg: <root>/link/.. is <root> after clean, but the parent of link target actually
+func checkDotDot(path string) error {
+	for _, elem := range strings.Split(filepath.ToSlash(path), "/") {
+		if elem == ".." {
+			return fmt.Errorf("%s should not contain ..", path)
+		}
+	}
+	return nil
+}
+
+// resolveParent return the absolute path with symlinks in parent directories evaluated
+func resolveParent(path string) (string, error) {
+	if err := checkDotDot(path); err != nil {
+		return "", err
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	dir, name := filepath.Split(path)
+	if name == "" {
+		return path, nil // root directory
+	}
+	dir, err = resolvePath(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// resolvePath return the absolute path with symlinks evaluated, so symlinks can not escape the roots
+// For path not exists yet, the nearest existing parent is evaluated
+func resolvePath(path string) (string, error) {
+	if err := checkDotDot(path); err != nil {
+		return "", err
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	var rest []string
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if _, lerr := os.Lstat(path); lerr == nil {
+			// writing to a dangling symlink creates the target, which is unknown here
+			return "", fmt.Errorf("%s is a dangling symlink", path)
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		rest = append([]string{filepath.Base(path)}, rest...)
+		path = parent
+	}
+}
+
+func pathWithin(path, root string) bool {
+	if path == root || root == string(filepath.Separator) {
+		return true
+	}
+	return strings.HasPrefix(path, root+string(filepath.Separator))
+}
+
+// checkPolicy write 403 with the reason and return false if err is not nil
+func checkPolicy(w http.ResponseWriter, err error) bool {
+	if err == nil {
+		return true
+	}
+	http.Error(w, err.Error(), http.StatusForbidden)
+	return false
+}
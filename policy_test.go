@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicy(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "atx-policy")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	tmpDir, _ = filepath.EvalSymlinks(tmpDir)
+
+	readDir := filepath.Join(tmpDir, "read")
+	writeDir := filepath.Join(tmpDir, "write")
+	os.MkdirAll(readDir, 0755)
+	os.MkdirAll(filepath.Join(writeDir, "secret"), 0755)
+	os.Symlink(readDir, filepath.Join(writeDir, "escape"))
+
+	policyFile := filepath.Join(tmpDir, "policy.json")
+	ioutil.WriteFile(policyFile, []byte(`{
+		"readRoots": ["`+readDir+`"],
+		"writeRoots": ["`+writeDir+`"],
+		"denyPaths": ["`+filepath.Join(writeDir, "secret")+`"],
+		"disableShell": true
+	}`), 0644)
+	p, err := loadPolicy(policyFile)
+	assert.NoError(t, err)
+
+	check := func(fn func(string) (string, error), path string) error {
+		_, err := fn(path)
+		return err
+	}
+	assert.NoError(t, check(p.CheckRead, filepath.Join(readDir, "a.txt")))
+	assert.NoError(t, check(p.CheckRead, filepath.Join(writeDir, "a.txt")))
+	assert.Error(t, check(p.CheckRead, filepath.Join(tmpDir, "a.txt")))
+	assert.Error(t, check(p.CheckRead, readDir+"-other"))
+
+	assert.NoError(t, check(p.CheckWrite, filepath.Join(writeDir, "not/exists/yet.txt")))
+	assert.Error(t, check(p.CheckWrite, filepath.Join(readDir, "a.txt")))
+	assert.Error(t, check(p.CheckWrite, writeDir+"/../read/a.txt"))
+	assert.Error(t, check(p.CheckWrite, filepath.Join(writeDir, "escape/a.txt"))) // symlink to read dir
+	assert.Error(t, check(p.CheckWrite, writeDir+"/escape/../a.txt"))             // lands in tmpDir actually
+	assert.Error(t, check(p.CheckWrite, filepath.Join(writeDir, "escape")))       // target is checked too
+	assert.Error(t, check(p.CheckWrite, filepath.Join(writeDir, "secret/a.txt")))
+	assert.Error(t, p.CheckShell())
+
+	os.Symlink(filepath.Join(tmpDir, "missing"), filepath.Join(writeDir, "dangling"))
+	assert.Error(t, check(p.CheckWrite, filepath.Join(writeDir, "dangling")))
+
+	// parent directories are resolved, the last element is kept
+	os.Symlink(writeDir, filepath.Join(tmpDir, "link"))
+	path, err := p.CheckWrite(filepath.Join(tmpDir, "link/a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(writeDir, "a.txt"), path)
+	ioutil.WriteFile(filepath.Join(writeDir, "a.txt"), []byte("a"), 0644)
+	os.Symlink(filepath.Join(writeDir, "a.txt"), filepath.Join(writeDir, "b.txt"))
+	path, err = p.CheckWrite(filepath.Join(writeDir, "b.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(writeDir, "b.txt"), path)
+
+	// protected paths are denied even if no roots
+	secret := filepath.Join(tmpDir, "tokens.json")
+	ioutil.WriteFile(secret, []byte("[]"), 0600)
+	p = &Policy{}
+	p.Protect(secret, filepath.Join(tmpDir, "records"))
+	assert.Error(t, check(p.CheckRead, secret))
+	assert.Error(t, check(p.CheckRead, filepath.Join(tmpDir, "link/../tokens.json")))
+	assert.Error(t, check(p.CheckWrite, filepath.Join(tmpDir, "records/a.cast")))
+	assert.NoError(t, check(p.CheckRead, filepath.Join(tmpDir, "policy.json")))
+
+	// default policy allows everything
+	path, err = policy.CheckWrite("/")
+	assert.NoError(t, err)
+	assert.Equal(t, "/", path)
+	assert.NoError(t, policy.CheckShell())
+}
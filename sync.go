@@ -0,0 +1,204 @@
+/*
+Handle directory sync, client post a manifest, agent reply what should be uploaded
+*/
+package main
+
+import (
+	"container/list"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type syncEntry struct {
+	Path   string `json:"path"` // relative to sync root, use / as separator
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+type syncManifest struct {
+	Files  []syncEntry `json:"files"`
+	Delete bool        `json:"delete"` // delete files not in manifest
+}
+
+type syncResult struct {
+	Missing    []string `json:"missing"`
+	Different  []string `json:"different"`
+	Extraneous []string `json:"extraneous"`
+	Deleted    []string `json:"deleted"`
+}
+
+const hashCacheMaxEntries = 10000
+
+// sha256 is slow for big files, cache by path, size and modtime
+type hashCacheEntry struct {
+	path    string
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// hashCache is a LRU cache, so memory is bounded on long-running agents
+type hashCache struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string]*list.Element
+	order   *list.List // front is the most recently used
+}
+
+var syncHashCache = newHashCache(hashCacheMaxEntries)
+
+func newHashCache(max int) *hashCache {
+	return &hashCache{
+		max:     max,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Get return the cached sum if the file is not changed
+func (c *hashCache) Get(path string, fi os.FileInfo) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[path]
+	if !ok {
+		return "", false
+	}
+	entry := elem.Value.(*hashCacheEntry)
+	if entry.size != fi.Size() || !entry.modTime.Equal(fi.ModTime()) {
+		return "", false
+	}
+	c.order.MoveToFront(elem)
+	return entry.sum, true
+}
+
+func (c *hashCache) Set(path string, fi os.FileInfo, sum string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &hashCacheEntry{path: path, size: fi.Size(), modTime: fi.ModTime(), sum: sum}
+	if elem, ok := c.entries[path]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[path] = c.order.PushFront(entry)
+	for c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*hashCacheEntry).path)
+	}
+}
+
+func (c *hashCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func cachedSha256File(path string, fi os.FileInfo) (string, error) {
+	if sum, ok := syncHashCache.Get(path, fi); ok {
+		return sum, nil
+	}
+	sum, err := sha256File(path)
+	if err != nil {
+		return "", err
+	}
+	syncHashCache.Set(path, fi, sum)
+	return sum, nil
+}
+
+// cleanSyncPath make sure the path is relative and do not go outside of root
+func cleanSyncPath(name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if clean == "." || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", errors.New("invalid sync path: " + name)
+	}
+	return clean, nil
+}
+
+// diffSync compare manifest with files under root
+func diffSync(root string, manifest syncManifest) (result syncResult, err error) {
+	// Walk does not follow root if it's a symlink, eg: /sdcard
+	if realRoot, err := filepath.EvalSymlinks(root); err == nil {
+		root = realRoot
+	}
+	result = syncResult{
+		Missing:    []string{},
+		Different:  []string{},
+		Extraneous: []string{},
+		Deleted:    []string{},
+	}
+	wanted := make(map[string]bool, len(manifest.Files))
+	for _, entry := range manifest.Files {
+		rel, err := cleanSyncPath(entry.Path)
+		if err != nil {
+			return result, err
+		}
+		wanted[rel] = true
+		fi, err := os.Stat(filepath.Join(root, rel))
+		if err != nil || fi.IsDir() {
+			result.Missing = append(result.Missing, entry.Path)
+			continue
+		}
+		if fi.Size() != entry.Size {
+			result.Different = append(result.Different, entry.Path)
+			continue
+		}
+		sum, err := cachedSha256File(filepath.Join(root, rel), fi)
+		if err != nil {
+			return result, err
+		}
+		if !strings.EqualFold(sum, entry.Sha256) {
+			result.Different = append(result.Different, entry.Path)
+		}
+	}
+
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == root {
+			return filepath.SkipDir // nothing synced yet
+		}
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		if !wanted[rel] {
+			result.Extraneous = append(result.Extraneous, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	sort.Strings(result.Extraneous)
+	if manifest.Delete {
+		for _, rel := range result.Extraneous {
+			if er := os.Remove(filepath.Join(root, filepath.FromSlash(rel))); er == nil {
+				result.Deleted = append(result.Deleted, rel)
+			}
+		}
+		removeEmptyDirs(root)
+	}
+	return result, nil
+}
+
+// removeEmptyDirs remove empty sub directories of root, root itself is kept
+func removeEmptyDirs(root string) {
+	var dirs []string
+	filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() && path != root {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	// deepest first
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i]) // fails if not empty
+	}
+}
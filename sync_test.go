@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffSync(t *testing.T) {
+	root, err := ioutil.TempDir("", "atx-sync")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, "a/old"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "a/same.txt"), []byte("hello world"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "a/changed.txt"), []byte("hello"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "a/old/extra.txt"), []byte("extra"), 0644)
+
+	manifest := syncManifest{
+		Files: []syncEntry{
+			// sha256 of "hello world"
+			{Path: "a/same.txt", Size: 11, Sha256: "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"},
+			{Path: "a/changed.txt", Size: 5, Sha256: "0000"},
+			{Path: "b/new.txt", Size: 3, Sha256: "0000"},
+		},
+		Delete: true,
+	}
+	result, err := diffSync(root, manifest)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b/new.txt"}, result.Missing)
+	assert.Equal(t, []string{"a/changed.txt"}, result.Different)
+	assert.Equal(t, []string{"a/old/extra.txt"}, result.Extraneous)
+	assert.Equal(t, []string{"a/old/extra.txt"}, result.Deleted)
+	assert.False(t, fileExists(filepath.Join(root, "a/old")))
+
+	_, err = diffSync(root, syncManifest{Files: []syncEntry{{Path: "../etc/passwd"}}})
+	assert.Error(t, err)
+
+	link := root + "-link"
+	assert.NoError(t, os.Symlink(root, link))
+	defer os.Remove(link)
+	result, err = diffSync(link, syncManifest{Files: manifest.Files[:1]})
+	assert.NoError(t, err)
+	assert.Empty(t, result.Missing)
+	assert.Equal(t, []string{"a/changed.txt"}, result.Extraneous)
+
+	result, err = diffSync(filepath.Join(root, "notexists"), manifest)
+	assert.NoError(t, err)
+	assert.Len(t, result.Missing, 3)
+}
+
+func TestHashCacheEvict(t *testing.T) {
+	root, err := ioutil.TempDir("", "atx-sync")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	var fis []os.FileInfo
+	for _, name := range []string{"1.txt", "2.txt", "3.txt"} {
+		path := filepath.Join(root, name)
+		ioutil.WriteFile(path, []byte(name), 0644)
+		fi, _ := os.Stat(path)
+		fis = append(fis, fi)
+	}
+	c := newHashCache(2)
+	c.Set(filepath.Join(root, "1.txt"), fis[0], "sum1")
+	c.Set(filepath.Join(root, "2.txt"), fis[1], "sum2")
+	_, ok := c.Get(filepath.Join(root, "1.txt"), fis[0]) // 2.txt becomes the oldest
+	assert.True(t, ok)
+	c.Set(filepath.Join(root, "3.txt"), fis[2], "sum3")
+	assert.Equal(t, 2, c.Len())
+
+	_, ok = c.Get(filepath.Join(root, "2.txt"), fis[1])
+	assert.False(t, ok)
+	sum, ok := c.Get(filepath.Join(root, "1.txt"), fis[0])
+	assert.True(t, ok)
+	assert.Equal(t, "sum1", sum)
+	ioutil.WriteFile(filepath.Join(root, "1.txt"), []byte("changed"), 0644)
+	fi, _ := os.Stat(filepath.Join(root, "1.txt"))
+	_, ok = c.Get(filepath.Join(root, "1.txt"), fi)
+	assert.False(t, ok)
+}
@@ -4,18 +4,29 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"os"
 	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/sirupsen/logrus"
+	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/kr/pty"
 )
 
+const (
+	termScrollbackSize = 64 * 1024
+	termWriteWait      = 10 * time.Second
+)
+
 type windowSize struct {
 	Rows uint16 `json:"rows"`
 	Cols uint16 `json:"cols"`
@@ -31,6 +42,263 @@ func lookShellPath() (string, error) {
 	return exec.LookPath("sh")
 }
 
+// termSession is a shell running in pty, which can be attached by one websocket at a time
+// Persistent session survive websocket disconnects, until explicit closed or shell quit
+type termSession struct {
+	Id         string    `json:"id"`
+	Persistent bool      `json:"persistent"`
+	Attached   bool      `json:"attached"`
+	CreatedAt  time.Time `json:"createdAt"`
+	Pid        int       `json:"pid"`
+	Recording  string    `json:"recording,omitempty"` // asciicast file name
+
+	mu         sync.Mutex
+	wmu        sync.Mutex // serialize websocket writes, never held together with mu except in Attach
+	cmd        *exec.Cmd
+	tty        *os.File
+	conn       *websocket.Conn
+	scrollback []byte
+	recorder   *asciicastRecorder
+	done       chan bool
+	cleanOnce  sync.Once
+}
+
+func newTermSession(id string, persistent bool, record bool) (*termSession, error) {
+	shPath, err := lookShellPath()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(shPath, "-l")
+	cmd.Env = append(os.Environ(), "TERM=xterm")
+	tty, err := pty.Start(cmd)
+	if err != nil {
+		return nil, err
+	}
+	s := &termSession{
+		Id:         id,
+		Persistent: persistent,
+		CreatedAt:  time.Now(),
+		Pid:        cmd.Process.Pid,
+		cmd:        cmd,
+		tty:        tty,
+		done:       make(chan bool),
+	}
+	if record {
+		if s.recorder, err = newAsciicastRecorder(id, 80, 24); err != nil {
+			s.cmd.Process.Kill()
+			s.cmd.Process.Wait()
+			tty.Close()
+			return nil, err
+		}
+		s.Recording = s.recorder.Name
+	}
+	go s.drainOutput()
+	return s, nil
+}
+
+// drainOutput keep reading pty, save to scrollback and forward to the attached websocket
+// The shell is reaped when the pty is closed, eg: user typed exit
+func (s *termSession) drainOutput() {
+	defer close(s.done)
+	defer s.cleanup()
+	if s.recorder != nil {
+		defer s.recorder.Close()
+	}
+	for {
+		buf := make([]byte, 1024)
+		read, err := s.tty.Read(buf)
+		s.mu.Lock()
+		conn := s.conn
+		if err == nil {
+			if s.recorder != nil {
+				s.recorder.Output(buf[:read])
+			}
+			s.scrollback = append(s.scrollback, buf[:read]...)
+			if len(s.scrollback) > termScrollbackSize {
+				s.scrollback = s.scrollback[len(s.scrollback)-termScrollbackSize:]
+			}
+		}
+		s.mu.Unlock()
+		// write without s.mu, a slow websocket should not block Status
+		if err != nil {
+			if conn != nil {
+				s.write(conn, websocket.TextMessage, []byte(err.Error()))
+				conn.Close()
+			}
+			return
+		}
+		if conn != nil {
+			s.write(conn, websocket.BinaryMessage, buf[:read])
+		}
+	}
+}
+
+// Attach replay the scrollback and kick the previous websocket
+func (s *termSession) Attach(conn *websocket.Conn) {
+	s.wmu.Lock() // output after the scrollback is written after the replay
+	defer s.wmu.Unlock()
+	s.mu.Lock()
+	prev := s.conn
+	s.conn = conn
+	s.Attached = true
+	scrollback := append([]byte(nil), s.scrollback...)
+	s.mu.Unlock()
+	if prev != nil {
+		termWrite(prev, websocket.TextMessage, []byte("session attached by another connection"))
+		prev.Close()
+	}
+	if len(scrollback) > 0 {
+		termWrite(conn, websocket.BinaryMessage, scrollback)
+	}
+}
+
+// write to websocket, gorilla websocket does not support concurrent writers
+func (s *termSession) write(conn *websocket.Conn, messageType int, data []byte) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return termWrite(conn, messageType, data)
+}
+
+func termWrite(conn *websocket.Conn, messageType int, data []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(termWriteWait))
+	return conn.WriteMessage(messageType, data)
+}
+
+func (s *termSession) Detach(conn *websocket.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == conn {
+		s.conn = nil
+		s.Attached = false
+	}
+}
+
+func (s *termSession) Resize(size windowSize) error {
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		s.tty.Fd(),
+		syscall.TIOCSWINSZ,
+		uintptr(unsafe.Pointer(&size)),
+	)
+	if errno != 0 {
+		return syscall.Errno(errno)
+	}
+	if s.recorder != nil {
+		s.recorder.Resize(int(size.Cols), int(size.Rows))
+	}
+	return nil
+}
+
+// Close kill the shell, safe to call multiple times or after the shell quit
+func (s *termSession) Close() {
+	s.cmd.Process.Kill()
+	s.cleanup()
+	<-s.done
+}
+
+// cleanup reap the shell and release the pty
+func (s *termSession) cleanup() {
+	s.cleanOnce.Do(func() {
+		s.cmd.Wait()
+		s.tty.Close()
+	})
+}
+
+// Status return a copy which is safe to encode as json
+func (s *termSession) Status() *termSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &termSession{
+		Id:         s.Id,
+		Persistent: s.Persistent,
+		Attached:   s.Attached,
+		CreatedAt:  s.CreatedAt,
+		Pid:        s.Pid,
+		Recording:  s.Recording,
+	}
+}
+
+type termSessionManager struct {
+	mu       sync.Mutex
+	sessions map[string]*termSession
+	n        int
+}
+
+var termSessions = &termSessionManager{
+	sessions: make(map[string]*termSession),
+}
+
+// GetOrCreate return the session named id, id empty means create a new one which is not persistent
+// record only works when the session is created
+func (m *termSessionManager) GetOrCreate(id string, record bool) (*termSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	persistent := id != ""
+	if persistent {
+		if s, ok := m.sessions[id]; ok {
+			return s, nil
+		}
+	} else {
+		m.n++
+		id = "tmp-" + strconv.Itoa(m.n)
+	}
+	s, err := newTermSession(id, persistent, record)
+	if err != nil {
+		return nil, err
+	}
+	m.sessions[id] = s
+	go func() {
+		<-s.done // shell quit
+		m.mu.Lock()
+		if m.sessions[id] == s {
+			delete(m.sessions, id)
+		}
+		m.mu.Unlock()
+	}()
+	return s, nil
+}
+
+func (m *termSessionManager) List() []*termSession {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]*termSession, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		list = append(list, s.Status())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+func (m *termSessionManager) Close(id string) error {
+	m.mu.Lock()
+	s, ok := m.sessions[id]
+	delete(m.sessions, id)
+	m.mu.Unlock()
+	if !ok {
+		return errors.New("session not found: " + id)
+	}
+	s.Close()
+	return nil
+}
+
+func handleTermSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(termSessions.List())
+}
+
+func handleTermSessionClose(w http.ResponseWriter, r *http.Request) {
+	if err := termSessions.Close(mux.Vars(r)["id"]); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	io.WriteString(w, "Success")
+}
+
+// handleTerminalWebsocket attach to the session given by ?session=<id>, create if not exists
+// Without session, the shell is killed when the websocket closed
+// ?record=true save the new session as asciicast file
 func handleTerminalWebsocket(w http.ResponseWriter, r *http.Request) {
 	l := logrus.WithField("remoteaddr", r.RemoteAddr)
 	conn, err := upgrader.Upgrade(w, r, nil)
@@ -38,38 +306,21 @@ func handleTerminalWebsocket(w http.ResponseWriter, r *http.Request) {
 		l.WithError(err).Error("Unable to upgrade connection")
 		return
 	}
-	shPath, err := lookShellPath()
-	if err != nil {
-		l.WithError(err).Error("Unable find shell path")
-		return
-	}
-	cmd := exec.Command(shPath, "-l")
-	cmd.Env = append(os.Environ(), "TERM=xterm")
-
-	tty, err := pty.Start(cmd)
+	sess, err := termSessions.GetOrCreate(r.FormValue("session"), r.FormValue("record") == "true")
 	if err != nil {
 		l.WithError(err).Error("Unable to start pty/cmd")
 		conn.WriteMessage(websocket.TextMessage, []byte(err.Error()))
+		conn.Close()
 		return
 	}
+	l = l.WithField("session", sess.Id)
+	sess.Attach(conn)
 	defer func() {
-		cmd.Process.Kill()
-		cmd.Process.Wait()
-		tty.Close()
-		conn.Close()
-	}()
-
-	go func() {
-		for {
-			buf := make([]byte, 1024)
-			read, err := tty.Read(buf)
-			if err != nil {
-				conn.WriteMessage(websocket.TextMessage, []byte(err.Error()))
-				l.WithError(err).Error("Unable to read from pty/cmd")
-				return
-			}
-			conn.WriteMessage(websocket.BinaryMessage, buf[:read])
+		sess.Detach(conn)
+		if !sess.Persistent {
+			termSessions.Close(sess.Id) // not found if the shell already quit
 		}
+		conn.Close()
 	}()
 
 	for {
@@ -81,7 +332,7 @@ func handleTerminalWebsocket(w http.ResponseWriter, r *http.Request) {
 
 		if messageType == websocket.TextMessage {
 			l.Warn("Unexpected text message")
-			conn.WriteMessage(websocket.TextMessage, []byte("Unexpected text message"))
+			sess.write(conn, websocket.TextMessage, []byte("Unexpected text message"))
 			continue
 		}
 
@@ -89,7 +340,7 @@ func handleTerminalWebsocket(w http.ResponseWriter, r *http.Request) {
 		read, err := reader.Read(dataTypeBuf)
 		if err != nil {
 			l.WithError(err).Error("Unable to read message type from reader")
-			conn.WriteMessage(websocket.TextMessage, []byte("Unable to read message type from reader"))
+			sess.write(conn, websocket.TextMessage, []byte("Unable to read message type from reader"))
 			return
 		}
 
@@ -100,7 +351,7 @@ func handleTerminalWebsocket(w http.ResponseWriter, r *http.Request) {
 
 		switch dataTypeBuf[0] {
 		case 0:
-			copied, err := io.Copy(tty, reader)
+			copied, err := io.Copy(sess.tty, reader)
 			if err != nil {
 				l.WithError(err).Errorf("Error after copying %d bytes", copied)
 			}
@@ -109,18 +360,12 @@ func handleTerminalWebsocket(w http.ResponseWriter, r *http.Request) {
 			resizeMessage := windowSize{}
 			err := decoder.Decode(&resizeMessage)
 			if err != nil {
-				conn.WriteMessage(websocket.TextMessage, []byte("Error decoding resize message: "+err.Error()))
+				sess.write(conn, websocket.TextMessage, []byte("Error decoding resize message: "+err.Error()))
 				continue
 			}
 			l.WithField("resizeMessage", resizeMessage).Info("Resizing terminal")
-			_, _, errno := syscall.Syscall(
-				syscall.SYS_IOCTL,
-				tty.Fd(),
-				syscall.TIOCSWINSZ,
-				uintptr(unsafe.Pointer(&resizeMessage)),
-			)
-			if errno != 0 {
-				l.WithError(syscall.Errno(errno)).Error("Unable to resize terminal")
+			if err := sess.Resize(resizeMessage); err != nil {
+				l.WithError(err).Error("Unable to resize terminal")
 			}
 		default:
 			l.WithField("dataType", dataTypeBuf[0]).Error("Unknown data type")
@@ -11,3 +11,11 @@ func handleTerminalWebsocket(w http.ResponseWriter, r *http.Request) {
 	// }
 	io.WriteString(w, "not support windows")
 }
+
+func handleTermSessions(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "not support windows", http.StatusNotImplemented)
+}
+
+func handleTermSessionClose(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "not support windows", http.StatusNotImplemented)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atx-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "agent.crt"), filepath.Join(dir, "agent.key")
+	assert.NoError(t, generateSelfSignedCert(certFile, keyFile))
+	config, err := loadTLSConfig(certFile, keyFile, "")
+	assert.NoError(t, err)
+	assert.Nil(t, config.ClientCAs)
+	fingerprint := certFingerprint(config.Certificates[0].Certificate[0])
+	assert.Len(t, fingerprint, 32*3-1)
+
+	// self-signed cert can also be used as client ca
+	config, err = loadTLSConfig(certFile, keyFile, certFile)
+	assert.NoError(t, err)
+	assert.Equal(t, tls.VerifyClientCertIfGiven, config.ClientAuth)
+
+	_, err = loadTLSConfig(certFile, keyFile, keyFile)
+	assert.Error(t, err)
+}
+
+func TestRequireClientCert(t *testing.T) {
+	handler := requireClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest("GET", "/info", nil)
+	req.TLS = &tls.ConnectionState{}
+	req.RemoteAddr = "10.0.0.2:4321"
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	req.RemoteAddr = "127.0.0.1:4321"
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"sort"
+	"sync"
+)
+
+// touchPoint is a contact position in minitouch native orientation, percent based
+type touchPoint struct {
+	Index    int     `json:"index"`
+	PercentX float64 `json:"xP"`
+	PercentY float64 `json:"yP"`
+}
+
+// touchTracker records the contacts sent by one /minitouch connection, so that minicap frames can be annotated.
+// Like minitouch, d/m/u only take effect after commit(c)
+type touchTracker struct {
+	mu       sync.Mutex
+	pending  map[int]*touchPoint // nil value means touch up
+	contacts map[int]touchPoint
+}
+
+func newTouchTracker() *touchTracker {
+	return &touchTracker{
+		pending:  make(map[int]*touchPoint),
+		contacts: make(map[int]touchPoint),
+	}
+}
+
+var (
+	activeTouchMu      sync.Mutex
+	activeTouchTracker *touchTracker // tracker of the latest /minitouch connection
+)
+
+// setActiveTouchTracker should be called when a /minitouch connection starts
+func setActiveTouchTracker(t *touchTracker) {
+	activeTouchMu.Lock()
+	defer activeTouchMu.Unlock()
+	activeTouchTracker = t
+}
+
+// releaseTouchTracker is called when the connection closed, a newer connection is not affected
+func releaseTouchTracker(t *touchTracker) {
+	activeTouchMu.Lock()
+	defer activeTouchMu.Unlock()
+	if activeTouchTracker == t {
+		activeTouchTracker = nil
+	}
+}
+
+// activeTouchContacts return committed contacts of the latest /minitouch connection
+func activeTouchContacts() []touchPoint {
+	activeTouchMu.Lock()
+	t := activeTouchTracker
+	activeTouchMu.Unlock()
+	if t == nil {
+		return nil
+	}
+	return t.Contacts()
+}
+
+func (t *touchTracker) Apply(req TouchRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch req.Operation {
+	case "d", "m":
+		t.pending[req.Index] = &touchPoint{
+			Index:    req.Index,
+			PercentX: req.PercentX,
+			PercentY: req.PercentY,
+		}
+	case "u":
+		t.pending[req.Index] = nil
+	case "c":
+		for index, pt := range t.pending {
+			if pt == nil {
+				delete(t.contacts, index)
+			} else {
+				t.contacts[index] = *pt
+			}
+		}
+		t.pending = make(map[int]*touchPoint)
+	}
+}
+
+// Contacts return committed contacts sorted by index
+func (t *touchTracker) Contacts() []touchPoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	points := make([]touchPoint, 0, len(t.contacts))
+	for _, pt := range t.contacts {
+		points = append(points, pt)
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Index < points[j].Index
+	})
+	return points
+}
+
+var touchMarkerColor = color.NRGBA{R: 255, G: 64, B: 64, A: 160}
+
+// annotateJPEG draw a circle marker for each contact on the jpeg frame
+func annotateJPEG(data []byte, points []touchPoint, rotation int) ([]byte, error) {
+	src, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	bounds := src.Bounds()
+	canvas := image.NewRGBA(bounds)
+	draw.Draw(canvas, bounds, src, bounds.Min, draw.Src)
+
+	radius := bounds.Dx() / 30
+	if radius < 6 {
+		radius = 6
+	}
+	marker := &image.Uniform{touchMarkerColor}
+	for _, pt := range points {
+		xP, yP := nativeToDisplay(pt.PercentX, pt.PercentY, rotation)
+		cx := bounds.Min.X + int(xP*float64(bounds.Dx()))
+		cy := bounds.Min.Y + int(yP*float64(bounds.Dy()))
+		mask := &circleMask{cx: cx, cy: cy, r: radius}
+		draw.DrawMask(canvas, mask.Bounds().Intersect(bounds), marker, image.ZP, mask, mask.Bounds().Intersect(bounds).Min, draw.Over)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := jpeg.Encode(buf, canvas, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// circleMask is an image.Image used as alpha mask for a filled circle
+type circleMask struct {
+	cx, cy, r int
+}
+
+func (c *circleMask) ColorModel() color.Model {
+	return color.AlphaModel
+}
+
+func (c *circleMask) Bounds() image.Rectangle {
+	return image.Rect(c.cx-c.r, c.cy-c.r, c.cx+c.r+1, c.cy+c.r+1)
+}
+
+func (c *circleMask) At(x, y int) color.Color {
+	dx, dy := x-c.cx, y-c.cy
+	if dx*dx+dy*dy <= c.r*c.r {
+		return color.Alpha{255}
+	}
+	return color.Alpha{0}
+}
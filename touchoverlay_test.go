@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTouchTrackerCommit(t *testing.T) {
+	tracker := newTouchTracker()
+	tracker.Apply(TouchRequest{Operation: "d", Index: 0, PercentX: 0.1, PercentY: 0.2})
+	tracker.Apply(TouchRequest{Operation: "d", Index: 1, PercentX: 0.3, PercentY: 0.4})
+	assert.Len(t, tracker.Contacts(), 0, "not committed")
+
+	tracker.Apply(TouchRequest{Operation: "c"})
+	assert.Equal(t, []touchPoint{{0, 0.1, 0.2}, {1, 0.3, 0.4}}, tracker.Contacts())
+
+	tracker.Apply(TouchRequest{Operation: "m", Index: 0, PercentX: 0.5, PercentY: 0.6})
+	tracker.Apply(TouchRequest{Operation: "u", Index: 1})
+	assert.Equal(t, []touchPoint{{0, 0.1, 0.2}, {1, 0.3, 0.4}}, tracker.Contacts())
+
+	tracker.Apply(TouchRequest{Operation: "c"})
+	assert.Equal(t, []touchPoint{{0, 0.5, 0.6}}, tracker.Contacts())
+
+	tracker.Apply(TouchRequest{Operation: "u", Index: 0})
+	tracker.Apply(TouchRequest{Operation: "c"})
+	assert.Len(t, tracker.Contacts(), 0)
+}
+
+func TestActiveTouchTracker(t *testing.T) {
+	older, newer := newTouchTracker(), newTouchTracker()
+	setActiveTouchTracker(older)
+	setActiveTouchTracker(newer) // older connection kicked
+	newer.Apply(TouchRequest{Operation: "d", Index: 0, PercentX: 0.5, PercentY: 0.5})
+	newer.Apply(TouchRequest{Operation: "c"})
+
+	releaseTouchTracker(older)
+	assert.Equal(t, []touchPoint{{0, 0.5, 0.5}}, activeTouchContacts())
+	releaseTouchTracker(newer)
+	assert.Len(t, activeTouchContacts(), 0)
+}
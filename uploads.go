@@ -0,0 +1,219 @@
+/*
+Handle resumable chunked uploads
+*/
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const uploadIdleTimeout = time.Hour
+
+var (
+	uploadManager = newUploadManager()
+
+	ErrUploadOffsetMismatch = errors.New("upload offset mismatch")
+	ErrUploadBusy           = errors.New("upload is busy with another request")
+)
+
+type uploadSession struct {
+	Id       string `json:"id"`
+	Target   string `json:"target"`
+	Offset   int64  `json:"offset"`           // bytes received
+	Size     int64  `json:"size,omitempty"`   // expected total size, 0 means unknown
+	Sha256   string `json:"sha256,omitempty"` // expected checksum
+	Mode     string `json:"mode"`
+	tempPath string
+	fileMode os.FileMode
+	busy     bool
+	timer    *time.Timer
+}
+
+type UploadManager struct {
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+}
+
+func newUploadManager() *UploadManager {
+	return &UploadManager{
+		sessions: make(map[string]*uploadSession, 10),
+	}
+}
+
+// Create an upload session, data is written to a temp file in the same directory of target,
+// so the final rename is atomic
+func (m *UploadManager) Create(target string, size int64, checksum string, mode os.FileMode) (*uploadSession, error) {
+	if target == "" || strings.HasSuffix(target, "/") {
+		return nil, errors.New("target should be a file path")
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return nil, err
+	}
+	id := filepath.Base(TempFileName("", ""))
+	tempPath := filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".upload-"+id)
+	f, err := os.OpenFile(tempPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	s := &uploadSession{
+		Id:       id,
+		Target:   target,
+		Size:     size,
+		Sha256:   strings.ToLower(checksum),
+		Mode:     fmt.Sprintf("0%o", mode),
+		tempPath: tempPath,
+		fileMode: mode,
+	}
+	s.timer = time.AfterFunc(uploadIdleTimeout, func() {
+		m.Abort(id)
+	})
+	m.mu.Lock()
+	m.sessions[id] = s
+	m.mu.Unlock()
+	return s, nil
+}
+
+// Get return a copy of the session status, nil if not found
+func (m *UploadManager) Get(id string) *uploadSession {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil
+	}
+	status := *s
+	return &status
+}
+
+// acquire mark session busy, so chunks of the same session are never written concurrently
+func (m *UploadManager) acquire(id string) (*uploadSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	if s.busy {
+		return nil, ErrUploadBusy
+	}
+	s.busy = true
+	s.timer.Reset(uploadIdleTimeout)
+	return s, nil
+}
+
+func (m *UploadManager) release(s *uploadSession) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s.busy = false
+}
+
+// WriteChunk append data at offset, offset must equal to the bytes already received
+// When the connection drops, the bytes written are kept and client can resume from the new offset
+func (m *UploadManager) WriteChunk(id string, offset int64, rd io.Reader) (status *uploadSession, err error) {
+	s, err := m.acquire(id)
+	if err != nil {
+		return nil, err
+	}
+	defer m.release(s)
+	if offset != s.Offset {
+		return nil, ErrUploadOffsetMismatch
+	}
+	f, err := os.OpenFile(s.tempPath, os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var written int64
+	if s.Size > 0 {
+		written, err = io.Copy(f, io.LimitReader(rd, s.Size-offset+1))
+	} else {
+		written, err = io.Copy(f, rd)
+	}
+	m.mu.Lock()
+	s.Offset += written
+	copied := *s
+	m.mu.Unlock()
+	if err == nil && s.Size > 0 && copied.Offset > s.Size {
+		err = fmt.Errorf("upload exceeds declared size %d", s.Size)
+		f.Truncate(s.Size)
+		m.mu.Lock()
+		s.Offset = s.Size
+		copied = *s
+		m.mu.Unlock()
+	}
+	return &copied, err
+}
+
+// Complete verify the size and sha256, then move temp file to target
+func (m *UploadManager) Complete(id string, checksum string) (status *uploadSession, err error) {
+	s, err := m.acquire(id)
+	if err != nil {
+		return nil, err
+	}
+	defer m.release(s)
+	if s.Size > 0 && s.Offset != s.Size {
+		return nil, fmt.Errorf("upload incomplete, expect size %d, got %d", s.Size, s.Offset)
+	}
+	if checksum == "" {
+		checksum = s.Sha256
+	}
+	realChecksum, err := sha256File(s.tempPath)
+	if err != nil {
+		return nil, err
+	}
+	if checksum != "" && !strings.EqualFold(checksum, realChecksum) {
+		return nil, fmt.Errorf("upload file checksum wrong, expected: %s, got: %s", checksum, realChecksum)
+	}
+	if s.fileMode != 0 {
+		os.Chmod(s.tempPath, s.fileMode)
+	}
+	if err = os.Rename(s.tempPath, s.Target); err != nil {
+		return nil, err
+	}
+	s.timer.Stop()
+	m.mu.Lock()
+	delete(m.sessions, id)
+	s.Sha256 = realChecksum
+	copied := *s
+	m.mu.Unlock()
+	return &copied, nil
+}
+
+// Abort remove the session and the temp file
+func (m *UploadManager) Abort(id string) error {
+	m.mu.Lock()
+	s, ok := m.sessions[id]
+	delete(m.sessions, id)
+	m.mu.Unlock()
+	if !ok {
+		return os.ErrNotExist
+	}
+	s.timer.Stop()
+	return os.Remove(s.tempPath)
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadManager(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "atx-upload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	m := newUploadManager()
+	target := filepath.Join(tmpDir, "sub/hello.txt")
+	// sha256 of "hello world"
+	session, err := m.Create(target, 11, "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", 0600)
+	assert.NoError(t, err)
+
+	status, err := m.WriteChunk(session.Id, 0, strings.NewReader("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), status.Offset)
+
+	_, err = m.WriteChunk(session.Id, 0, strings.NewReader("hello"))
+	assert.Equal(t, ErrUploadOffsetMismatch, err)
+
+	_, err = m.Complete(session.Id, "")
+	assert.Error(t, err) // incomplete
+
+	_, err = m.WriteChunk(session.Id, 5, strings.NewReader(" world"))
+	assert.NoError(t, err)
+	_, err = m.Complete(session.Id, "")
+	assert.NoError(t, err)
+	assert.Nil(t, m.Get(session.Id))
+
+	data, err := ioutil.ReadFile(target)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+	files, _ := ioutil.ReadDir(filepath.Dir(target))
+	assert.Len(t, files, 1) // temp file renamed
+
+	session, err = m.Create(filepath.Join(tmpDir, "bad.txt"), 0, "", 0644)
+	assert.NoError(t, err)
+	m.WriteChunk(session.Id, 0, strings.NewReader("hello"))
+	_, err = m.Complete(session.Id, "0000")
+	assert.Error(t, err) // checksum wrong
+	assert.NoError(t, m.Abort(session.Id))
+	assert.False(t, fileExists(filepath.Join(tmpDir, "bad.txt")))
+}
@@ -175,6 +175,9 @@ func pidOf(packageName string) (pid int, err error) {
 
 // get main activity with packageName
 func mainActivityOf(packageName string) (activity string, err error) {
+	if !validPackageNameRe.MatchString(packageName) {
+		return "", errors.New("invalid package name: " + packageName)
+	}
 	output, err := runShellOutput("pm", "list", "packages", "-f", packageName)
 	if err != nil {
 		log.Println("pm list err:", err)
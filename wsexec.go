@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/codeskyblue/kexec"
+)
+
+// execMessage is the json message of /exec websocket
+// client send: stdin, eof, signal
+// server send: stdout, stderr, exit, error
+type execMessage struct {
+	Type     string `json:"type"`
+	Data     string `json:"data,omitempty"`
+	Signal   string `json:"signal,omitempty"`
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+var execSignals = map[string]syscall.Signal{
+	"SIGINT":  syscall.SIGINT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGKILL": syscall.SIGKILL,
+}
+
+// handleExecWebsocket run command with stdin, stdout and stderr all over websocket
+func handleExecWebsocket(w http.ResponseWriter, r *http.Request) {
+	command := r.FormValue("command")
+	if command == "" {
+		command = r.FormValue("c")
+	}
+	if command == "" {
+		http.Error(w, "command is empty", http.StatusBadRequest)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("exec websocket upgrade error:", err)
+		return
+	}
+	defer conn.Close()
+
+	const wsWriteWait = 10 * time.Second
+	var wmu sync.Mutex
+	send := func(msg execMessage) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		return conn.WriteJSON(msg)
+	}
+
+	cmd := kexec.CommandString(command)
+	cmd.Dir = r.FormValue("dir")
+	cmd.Env = append(os.Environ(), r.Form["env"]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		send(execMessage{Type: "error", Error: err.Error()})
+		return
+	}
+	cmd.Stdout = newFakeWriter(func(data []byte) (int, error) {
+		return len(data), send(execMessage{Type: "stdout", Data: string(data)})
+	})
+	cmd.Stderr = newFakeWriter(func(data []byte) (int, error) {
+		return len(data), send(execMessage{Type: "stderr", Data: string(data)})
+	})
+	if err := cmd.Start(); err != nil {
+		send(execMessage{Type: "error", Error: err.Error()})
+		return
+	}
+	log.Printf("exec %q from %v", command, r.RemoteAddr)
+
+	quitC := make(chan bool)
+	go func() {
+		for {
+			var msg execMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				select {
+				case <-quitC:
+				default:
+					log.Println("exec websocket closed, kill command:", err)
+					cmd.Terminate(syscall.SIGKILL)
+				}
+				return
+			}
+			switch msg.Type {
+			case "stdin":
+				if _, err := stdin.Write([]byte(msg.Data)); err != nil {
+					send(execMessage{Type: "error", Error: err.Error()})
+				}
+			case "eof":
+				stdin.Close()
+			case "signal":
+				sig, ok := execSignals[msg.Signal]
+				if !ok {
+					send(execMessage{Type: "error", Error: "unsupported signal: " + msg.Signal})
+					continue
+				}
+				if err := cmd.Terminate(sig); err != nil {
+					send(execMessage{Type: "error", Error: err.Error()})
+				}
+			default:
+				send(execMessage{Type: "error", Error: "unsupported message type: " + msg.Type})
+			}
+		}
+	}()
+
+	err = cmd.Wait()
+	close(quitC)
+	exitMsg := execMessage{Type: "exit"}
+	if cmd.ProcessState != nil {
+		if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+			exitCode := ws.ExitStatus()
+			exitMsg.ExitCode = &exitCode
+		}
+	}
+	if exitMsg.ExitCode == nil && err != nil {
+		exitMsg.Error = err.Error()
+	}
+	send(exitMsg)
+}